@@ -0,0 +1,460 @@
+package main
+
+import (
+	"errors"
+	"syscall/js"
+	"time"
+
+	"globe-and-citizen/layer8/middleware/internals"
+	"globe-and-citizen/layer8/middleware/storage"
+)
+
+// settings holds the middleware behaviour set through configure
+var settings struct {
+	// exposeSharedSecret echoes the shared secret in the x-shared-secret
+	// header of the handshake response, for clients predating key confirmation
+	exposeSharedSecret bool
+	// jwtVerifier validates the mp-JWT of the handshakes when set
+	jwtVerifier *internals.JWTVerifier
+	// replayProtection requires a fresh sequence number and timestamp in
+	// every encrypted request
+	replayProtection bool
+	// maxClockSkew is the accepted age of the request timestamps
+	maxClockSkew time.Duration
+	// limits bounds the size of the requests
+	limits internals.RouteLimits
+}
+
+// configure applies the options given to `tunnel()` on the Node side. The
+// second argument is the Node `fs` module.
+//
+// Supported options:
+//   - store: a custom session store (see jsSessionStore)
+//   - sessionTTL: maximum lifetime of a session in milliseconds, whatever the store
+//   - idleTimeout: expiry of unused sessions in milliseconds, in-memory store only
+//   - maxSessions: maximum number of sessions, the least recently used are
+//     evicted, in-memory store only
+//   - persist: { path, secret } saves the server key pair and the sessions to
+//     an encrypted file and reloads them on startup
+//   - serverKey: the server ECDH private key (see LoadServerKey), it takes
+//     precedence over a persisted key pair
+//   - keyRotation: { interval, grace } rotates the server key pair every
+//     interval milliseconds, sessions derived from a rotated key stay valid
+//     for grace milliseconds
+//   - exposeSharedSecret: sends the shared secret back in the x-shared-secret
+//     header of the handshake response (legacy clients only, off by default)
+//   - jwt: { secret | publicKey, audience, leeway } verifies the mp-JWT of the
+//     handshakes with an HMAC secret or a PEM public key, checks its audience
+//     and expiry (with leeway milliseconds of clock skew) and that its subject
+//     is the x-client-uuid
+//   - replayProtection: true or { maxClockSkew } rejects the encrypted requests
+//     whose sequence number was already seen or whose timestamp is more than
+//     maxClockSkew milliseconds (5 minutes by default) away from the server clock.
+//     Stores shared by several processes must implement acceptSeq() for the
+//     guarantee to hold across them
+//   - limits: { envelope, body, files, fileSize, routes } bounds the encrypted
+//     and the decrypted request bodies, the number of files of a multipart
+//     request and their size; sizes are numbers of bytes or strings such as
+//     "10mb". routes overrides them for URL path prefixes, e.g.
+//     { "/upload": { body: "500mb" } }
+//
+// The idle timeout, the session cap and the persisted sessions apply to the
+// built-in in-memory store only; combining the first two with a store is an
+// error.
+// It returns an error message, or null when the options were applied.
+func configure(this js.Value, args []js.Value) interface{} {
+	if len(args) == 0 || args[0].Type() != js.TypeObject {
+		return nil
+	}
+	var (
+		options = args[0]
+		fs      = js.Undefined()
+		db      = storage.GetInMemStorage()
+	)
+	if len(args) > 1 {
+		fs = args[1]
+	}
+
+	if v := options.Get("exposeSharedSecret"); v.Type() == js.TypeBoolean {
+		settings.exposeSharedSecret = v.Bool()
+	}
+
+	if jwtOptions := options.Get("jwt"); jwtOptions.Truthy() {
+		verifier, err := newJWTVerifier(jwtOptions)
+		if err != nil {
+			return err.Error()
+		}
+		settings.jwtVerifier = verifier
+	}
+
+	switch v := options.Get("replayProtection"); v.Type() {
+	case js.TypeBoolean:
+		settings.replayProtection = v.Bool()
+	case js.TypeObject:
+		settings.replayProtection = true
+		if skew := v.Get("maxClockSkew"); skew.Type() == js.TypeNumber {
+			settings.maxClockSkew = time.Duration(skew.Float()) * time.Millisecond
+		}
+	}
+
+	if v := options.Get("limits"); v.Truthy() {
+		limits, err := newLimits(v)
+		if err != nil {
+			return err.Error()
+		}
+		settings.limits = limits
+	}
+
+	store := options.Get("store")
+	storageOptions := []storage.Option{}
+	if sessionOptions, ok := getSessionOptions(options); ok {
+		if store.Truthy() && (sessionOptions.IdleTimeout > 0 || sessionOptions.MaxSessions > 0) {
+			return "idleTimeout and maxSessions apply to the in-memory store only, they cannot be combined with store"
+		}
+		storageOptions = append(storageOptions, storage.WithSessionOptions(sessionOptions))
+	}
+	if persist := options.Get("persist"); persist.Truthy() {
+		persistence, err := newPersistence(persist, fs)
+		if err != nil {
+			return err.Error()
+		}
+		storageOptions = append(storageOptions, storage.WithPersistence(persistence))
+	}
+	if len(storageOptions) > 0 {
+		err := storage.InitInMemStorage(db.ECDH.GetPrivateKey(), db.ECDH.GetPublicKey(), storageOptions...)
+		if err != nil {
+			return err.Error()
+		}
+	}
+
+	if serverKey := options.Get("serverKey"); serverKey.Truthy() {
+		if serverKey.Type() == js.TypeObject {
+			serverKey = js.Global().Get("JSON").Call("stringify", serverKey)
+		}
+		if err := loadServerKey(serverKey.String()); err != nil {
+			return err.Error()
+		}
+	}
+
+	if keyRotation := options.Get("keyRotation"); keyRotation.Truthy() {
+		interval, grace := keyRotation.Get("interval"), keyRotation.Get("grace")
+		if interval.Type() != js.TypeNumber || interval.Float() <= 0 {
+			return "keyRotation.interval must be a positive number of milliseconds"
+		}
+		rotationGrace := storage.DefaultKeyGrace
+		if grace.Type() == js.TypeNumber {
+			rotationGrace = time.Duration(grace.Float()) * time.Millisecond
+		}
+		storage.StartKeyRotation(time.Duration(interval.Float())*time.Millisecond, rotationGrace)
+	}
+
+	if store.Truthy() {
+		s, err := newJSSessionStore(store)
+		if err != nil {
+			return err.Error()
+		}
+		storage.SetSessionStore(s)
+	}
+
+	return nil
+}
+
+// getSessionOptions reads the session limits, ok is false when none is set
+func getSessionOptions(options js.Value) (sessionOptions storage.SessionOptions, ok bool) {
+	if v := options.Get("sessionTTL"); v.Type() == js.TypeNumber {
+		sessionOptions.TTL = time.Duration(v.Float()) * time.Millisecond
+		ok = true
+	}
+	if v := options.Get("idleTimeout"); v.Type() == js.TypeNumber {
+		sessionOptions.IdleTimeout = time.Duration(v.Float()) * time.Millisecond
+		ok = true
+	}
+	if v := options.Get("maxSessions"); v.Type() == js.TypeNumber {
+		sessionOptions.MaxSessions = v.Int()
+		ok = true
+	}
+	return sessionOptions, ok
+}
+
+// newJWTVerifier reads the `jwt` option
+func newJWTVerifier(options js.Value) (*internals.JWTVerifier, error) {
+	var (
+		secret, publicKey string
+		audience          []string
+		leeway            time.Duration
+	)
+	if v := options.Get("secret"); v.Type() == js.TypeString {
+		secret = v.String()
+	}
+	if v := options.Get("publicKey"); v.Type() == js.TypeString {
+		publicKey = v.String()
+	}
+	switch v := options.Get("audience"); v.Type() {
+	case js.TypeString:
+		audience = []string{v.String()}
+	case js.TypeObject:
+		for i := 0; i < v.Length(); i++ {
+			audience = append(audience, v.Index(i).String())
+		}
+	}
+	if v := options.Get("leeway"); v.Type() == js.TypeNumber {
+		leeway = time.Duration(v.Float()) * time.Millisecond
+	}
+
+	return internals.NewJWTVerifier(secret, publicKey, audience, leeway)
+}
+
+// newLimits reads the `limits` option
+func newLimits(options js.Value) (internals.RouteLimits, error) {
+	var (
+		limits internals.RouteLimits
+		err    error
+	)
+	if limits.Limits, err = readLimits(options, "limits"); err != nil {
+		return limits, err
+	}
+
+	if routes := options.Get("routes"); routes.Truthy() {
+		limits.Routes = make(map[string]internals.Limits)
+		prefixes := js.Global().Get("Object").Call("keys", routes)
+		for i := 0; i < prefixes.Length(); i++ {
+			prefix := prefixes.Index(i).String()
+			if limits.Routes[prefix], err = readLimits(routes.Get(prefix), "limits.routes["+prefix+"]"); err != nil {
+				return limits, err
+			}
+		}
+	}
+	return limits, nil
+}
+
+// readLimits reads the limits of the `limits` option or of one of its routes
+func readLimits(options js.Value, name string) (internals.Limits, error) {
+	var limits internals.Limits
+	sizes := []struct {
+		option string
+		limit  *int
+	}{
+		{"envelope", &limits.MaxEnvelopeSize},
+		{"body", &limits.MaxBodySize},
+		{"fileSize", &limits.MaxFileSize},
+	}
+	for _, size := range sizes {
+		n, err := sizeOption(options.Get(size.option), name+"."+size.option)
+		if err != nil {
+			return limits, err
+		}
+		*size.limit = n
+	}
+
+	if v := options.Get("files"); v.Type() == js.TypeNumber {
+		limits.MaxFiles = v.Int()
+	}
+	return limits, nil
+}
+
+// sizeOption reads a size given as a number of bytes or as a string such as
+// "10mb", 0 when it is undefined
+func sizeOption(v js.Value, name string) (int, error) {
+	switch v.Type() {
+	case js.TypeNumber:
+		return v.Int(), nil
+	case js.TypeString:
+		n, err := internals.ParseSize(v.String())
+		if err != nil {
+			return 0, errors.New(name + ": " + err.Error())
+		}
+		return n, nil
+	case js.TypeUndefined, js.TypeNull:
+		return 0, nil
+	default:
+		return 0, errors.New(name + " must be a number of bytes or a string such as \"10mb\"")
+	}
+}
+
+// processOptions returns the options used to decrypt the requests of the
+// session: the size limits and, when it is on, the replay protection
+func processOptions(clientUUID string) *internals.ProcessOptions {
+	options := &internals.ProcessOptions{
+		MaxEnvelopeSize: settings.limits.MaxEnvelopeSize(),
+		Limits:          &settings.limits,
+	}
+	if !settings.replayProtection {
+		return options
+	}
+	options.Replay = sessionReplay(clientUUID)
+	options.MaxClockSkew = settings.maxClockSkew
+	return options
+}
+
+// sessionReplay records the sequence numbers of a client through the session
+// store, see storage.ReplayStore
+type sessionReplay string
+
+// Accept records the sequence number once the request is decrypted, after
+// any other request of the client received in the meantime. The session is
+// read and stored again without yielding to the event loop, so that two
+// concurrent replays cannot both be accepted.
+func (clientUUID sessionReplay) Accept(seq uint64) bool {
+	store := storage.GetInMemStorage().Sessions
+	if store, ok := store.(storage.ReplayStore); ok {
+		accepted, err := store.AcceptSeq(string(clientUUID), seq)
+		if err != nil {
+			println("error recording sequence number:", err.Error())
+			return false
+		}
+		return accepted
+	}
+
+	session, err := store.Get(string(clientUUID))
+	if err != nil {
+		println("error recording sequence number:", err.Error())
+		return false
+	}
+	// sessions created before replay protection was enabled start a new window
+	if session.Replay == nil {
+		session.Replay = new(storage.ReplayWindow)
+	}
+	if !session.Replay.Accept(seq) {
+		return false
+	}
+	if err := store.Put(string(clientUUID), session); err != nil {
+		println("error saving replay window:", err.Error())
+		return false
+	}
+	return true
+}
+
+// staticOptions are the options given to `static()`
+type staticOptions struct {
+	// StaticOptions maps the URL paths to the files
+	internals.StaticOptions
+	// mimeTypes overrides the content types of the files by extension, see
+	// internals.ContentType
+	mimeTypes map[string]string
+	// cache keeps the contents of the files in memory when it is set, see
+	// storage.FileCache
+	cache *storage.FileCacheOptions
+}
+
+// newStaticOptions reads the options given to `static()`, undefined when
+// there are none
+//
+// Supported options:
+//   - dotfiles: "allow", "deny" (403) or "ignore" (404, the default)
+//   - index: the file, or the list of files, served for a directory,
+//     "index.html" by default, false to serve none
+//   - redirect: redirects the directories requested without a trailing slash
+//     to the path with one, true by default
+//   - extensions: the extensions tried when no file matches, e.g. ["html"]
+//   - fallback: the file served when no file matches, e.g. "/index.html" for
+//     a single page application
+//   - mimeTypes: the content types by extension, e.g. { md: "text/markdown" },
+//     over the built-in ones
+//   - cache: true to keep the contents of the files in memory, or the bounds
+//     of the cache, { maxBytes: "32mb", maxEntries: 1000 } by default
+func newStaticOptions(options js.Value) (staticOptions, error) {
+	static := staticOptions{
+		StaticOptions: internals.StaticOptions{
+			Dotfiles: internals.DotfilesIgnore,
+			Index:    []string{"index.html"},
+			Redirect: true,
+		},
+	}
+	if !options.Truthy() {
+		return static, nil
+	}
+
+	switch v := options.Get("dotfiles"); v.Type() {
+	case js.TypeUndefined:
+	case js.TypeString:
+		switch dotfiles := internals.Dotfiles(v.String()); dotfiles {
+		case internals.DotfilesAllow, internals.DotfilesDeny, internals.DotfilesIgnore:
+			static.Dotfiles = dotfiles
+		default:
+			return static, errors.New(`static dotfiles must be "allow", "deny" or "ignore"`)
+		}
+	default:
+		return static, errors.New(`static dotfiles must be "allow", "deny" or "ignore"`)
+	}
+
+	if v := options.Get("index"); v.Type() == js.TypeBoolean && !v.Bool() {
+		static.Index = nil
+	} else if v.Type() != js.TypeUndefined {
+		index, ok := stringList(v)
+		if !ok {
+			return static, errors.New("static index must be a file name, a list of file names or false")
+		}
+		static.Index = index
+	}
+
+	if v := options.Get("redirect"); v.Type() == js.TypeBoolean {
+		static.Redirect = v.Bool()
+	}
+
+	if v := options.Get("extensions"); v.Type() != js.TypeUndefined {
+		extensions, ok := stringList(v)
+		if !ok {
+			return static, errors.New("static extensions must be a list of extensions")
+		}
+		static.Extensions = extensions
+	}
+
+	switch v := options.Get("fallback"); v.Type() {
+	case js.TypeUndefined:
+	case js.TypeString:
+		static.Fallback = v.String()
+	default:
+		return static, errors.New("static fallback must be the URL path of a file")
+	}
+
+	if v := options.Get("mimeTypes"); v.Truthy() {
+		static.mimeTypes = make(map[string]string)
+		extensions := js.Global().Get("Object").Call("keys", v)
+		for i := 0; i < extensions.Length(); i++ {
+			ext := extensions.Index(i).String()
+			if v.Get(ext).Type() != js.TypeString {
+				return static, errors.New("static mimeTypes must map extensions to content types")
+			}
+			static.mimeTypes[ext] = v.Get(ext).String()
+		}
+	}
+
+	switch v := options.Get("cache"); v.Type() {
+	case js.TypeUndefined, js.TypeNull:
+	case js.TypeBoolean:
+		if v.Bool() {
+			static.cache = &storage.FileCacheOptions{}
+		}
+	case js.TypeObject:
+		maxBytes, err := sizeOption(v.Get("maxBytes"), "static cache.maxBytes")
+		if err != nil {
+			return static, err
+		}
+		static.cache = &storage.FileCacheOptions{MaxBytes: maxBytes}
+		if n := v.Get("maxEntries"); n.Type() == js.TypeNumber {
+			static.cache.MaxEntries = n.Int()
+		}
+	default:
+		return static, errors.New("static cache must be a boolean or { maxBytes, maxEntries }")
+	}
+	return static, nil
+}
+
+// stringList reads an option given as a string or as an array of strings
+func stringList(v js.Value) ([]string, bool) {
+	if v.Type() == js.TypeString {
+		return []string{v.String()}, true
+	}
+	if !js.Global().Get("Array").Call("isArray", v).Bool() {
+		return nil, false
+	}
+
+	list := make([]string, v.Length())
+	for i := range list {
+		if v.Index(i).Type() != js.TypeString {
+			return nil, false
+		}
+		list[i] = v.Index(i).String()
+	}
+	return list, true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall/js"
+
+	"globe-and-citizen/layer8/middleware/internals"
+	"globe-and-citizen/layer8/middleware/storage"
+)
+
+// rekeyHeader asks the interceptor to redo the ECDH handshake and retry the
+// request. Its value is the reason: "expired", "unknown" or "invalid-key".
+const rekeyHeader = "x-layer8-rekey"
+
+// sessionError converts the error of a session lookup
+func sessionError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrSessionExpired):
+		return internals.ErrUnknownSession.WithMessage("Session expired").Wrap(err)
+	case errors.Is(err, storage.ErrSessionNotFound):
+		return internals.ErrUnknownSession.WithMessage("Unknown session").Wrap(err)
+	}
+	return internals.ErrInternal.Wrap(errors.New("error getting session: " + err.Error()))
+}
+
+// rekeyReason returns the value of the rekeyHeader for the errors that a new
+// handshake resolves, or an empty string
+func rekeyReason(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrSessionExpired):
+		return "expired"
+	case errors.Is(err, internals.ErrUnknownSession):
+		return "unknown"
+	case errors.Is(err, internals.ErrDecryption):
+		// the client holds a key the server no longer has, e.g. after a
+		// handshake with another instance sharing the session store
+		return "invalid-key"
+	}
+	return ""
+}
+
+// sendError ends the response with the plaintext JSON body of the error, see
+// internals.Error, and its code in the x-layer8-error header so that the
+// interceptor can act on it. A response whose headers were already sent is
+// destroyed instead: the status cannot change anymore, and closing the
+// connection tells the client that the body is incomplete.
+func sendError(res js.Value, err error) {
+	println("error handling request:", err.Error())
+	if res.Get("headersSent").Truthy() {
+		if !res.Get("writableEnded").Truthy() {
+			res.Call("destroy")
+		}
+		return
+	}
+
+	e := internals.AsError(err)
+	res.Set("statusCode", e.Status)
+	res.Set("statusMessage", e.Message)
+	res.Call("setHeader", "content-type", "application/json")
+	res.Call("setHeader", "x-layer8-error", string(e.Code))
+	if reason := rekeyReason(err); reason != "" {
+		res.Call("setHeader", rekeyHeader, reason)
+	}
+	res.Call("end", string(e.Body()))
+}
+
+// recoverRequest is deferred by the JS callbacks handling a request. A panic
+// in a callback would otherwise stop the Go runtime, failing every later
+// request; instead it is logged and the request fails with a 500.
+func recoverRequest(res js.Value) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	// ending the response can throw too, e.g. when it was already ended
+	defer func() {
+		if r := recover(); r != nil {
+			println("error ending response:", fmt.Sprint(r))
+		}
+	}()
+	sendError(res, internals.ErrInternal.Wrap(fmt.Errorf("panic: %v", r)))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall/js"
+
+	"globe-and-citizen/layer8/middleware/storage"
+)
+
+// filePersister saves the storage to a file through the injected Node `fs` module
+type filePersister struct {
+	fs   js.Value
+	path string
+}
+
+// call invokes a method of fs, turning thrown JavaScript errors into Go errors
+func (p *filePersister) call(method string, args ...interface{}) (result js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("fs.%s failed: %v", method, r)
+		}
+	}()
+	return p.fs.Call(method, args...), nil
+}
+
+func (p *filePersister) Load() ([]byte, error) {
+	exists, err := p.call("existsSync", p.path)
+	if err != nil || !exists.Bool() {
+		return nil, err
+	}
+
+	buffer, err := p.call("readFileSync", p.path)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, buffer.Get("length").Int())
+	js.CopyBytesToGo(b, buffer)
+	return b, nil
+}
+
+// Save writes to a temporary file first so that a crash never leaves a partial file behind
+func (p *filePersister) Save(data []byte) error {
+	buffer := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(buffer, data)
+
+	tmp := p.path + ".tmp"
+	if _, err := p.call("writeFileSync", tmp, buffer, map[string]interface{}{"mode": 0600}); err != nil {
+		return err
+	}
+	_, err := p.call("renameSync", tmp, p.path)
+	return err
+}
+
+// newPersistence reads the `persist` option: { path: string, secret: string }
+func newPersistence(options, fs js.Value) (*storage.Persistence, error) {
+	path, secret := options.Get("path"), options.Get("secret")
+	if path.Type() != js.TypeString || path.String() == "" {
+		return nil, errors.New("persist.path must be a non-empty string")
+	}
+	if secret.Type() != js.TypeString || secret.String() == "" {
+		return nil, errors.New("persist.secret must be a non-empty string")
+	}
+	if fs.Type() != js.TypeObject {
+		return nil, errors.New("fs module is required to persist the storage")
+	}
+
+	return &storage.Persistence{
+		Persister: &filePersister{fs: fs, path: path.String()},
+		Secret:    []byte(secret.String()),
+	}, nil
+}
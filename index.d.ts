@@ -1,5 +1,137 @@
+export interface SessionStore {
+    /** Returns the serialized session of the client, or null/undefined when there is none. */
+    get(clientUUID: string): string | null | undefined;
+    /** Creates or replaces the serialized session of the client. */
+    put(clientUUID: string, session: string): void;
+    delete(clientUUID: string): void;
+    /** Marks the session of the client as recently used. */
+    touch(clientUUID: string): void;
+    /**
+     * Records the sequence number of a request for the session of the client, atomically,
+     * and returns whether it was new. Without it, replay protection reads and writes the
+     * session through get() and put(), which is only atomic within one process.
+     */
+    acceptSeq?(clientUUID: string, seq: number): boolean;
+}
+export interface TunnelOptions {
+    /** A custom session store, defaults to an in-memory store. Methods must be synchronous. */
+    store?: SessionStore;
+    /** Maximum lifetime of a session in milliseconds, counted from the handshake. */
+    sessionTTL?: number;
+    /** Sessions unused for this many milliseconds expire. In-memory store only, not combinable with `store`. */
+    idleTimeout?: number;
+    /**
+     * Maximum number of sessions kept, the least recently used are evicted first. In-memory
+     * store only, not combinable with `store`.
+     */
+    maxSessions?: number;
+    /**
+     * Saves the server key pair and the sessions to `path`, encrypted with a key
+     * derived from `secret`, and reloads them on startup.
+     */
+    persist?: {
+        path: string;
+        secret: string;
+    };
+    /** The server ECDH private key as a P-256 JWK, see loadServerKey. */
+    serverKey?: object | string;
+    /**
+     * Rotates the server key pair every `interval` milliseconds. Sessions derived from a
+     * rotated key stay valid for `grace` milliseconds (one hour by default).
+     */
+    keyRotation?: {
+        interval: number;
+        grace?: number;
+    };
+    /**
+     * Sends the shared secret back in the `x-shared-secret` header of the handshake
+     * response. Only for clients that cannot verify the `x-key-confirmation` header.
+     */
+    exposeSharedSecret?: boolean;
+    /**
+     * Verifies the mp-JWT of the handshakes, rejecting them with a 401 on failure. The token
+     * must be signed with `secret` (HMAC) or with the key matching `publicKey` (PEM, ECDSA
+     * or RSA), must not be expired, must have one of the `audience` values when given, and
+     * its subject must be the client UUID.
+     */
+    jwt?: {
+        secret?: string;
+        publicKey?: string;
+        audience?: string | string[];
+        /** Tolerated clock skew in milliseconds. */
+        leeway?: number;
+    };
+    /**
+     * Rejects encrypted requests whose `seq` was already accepted for the session, or whose
+     * `ts` (milliseconds since the epoch) is more than `maxClockSkew` milliseconds away from
+     * the server clock (5 minutes by default). Clients must then send both fields. With a
+     * store shared by several processes, the store must implement acceptSeq().
+     */
+    replayProtection?: boolean | {
+        maxClockSkew?: number;
+    };
+    /**
+     * Bounds the size of the requests, rejecting them with a 413 as soon as a limit is
+     * exceeded. `routes` overrides the limits for the URL paths under a prefix, the longest
+     * matching prefix applies.
+     */
+    limits?: RequestLimits & {
+        routes?: {
+            [prefix: string]: RequestLimits;
+        };
+    };
+}
+/** Sizes are numbers of bytes or strings such as "512kb" or "10mb". */
+export interface RequestLimits {
+    /** Largest encrypted request body, "10mb" by default. */
+    envelope?: number | string;
+    /** Largest decrypted request body, "10mb" by default. */
+    body?: number | string;
+    /** Largest number of files in a multipart request, 20 by default. */
+    files?: number;
+    /** Largest file in a multipart request, "10mb" by default. */
+    fileSize?: number | string;
+}
+/** Replaces the server ECDH key pair with a P-256 private JWK given as an object, JSON or base64 string. */
+export declare function loadServerKey(jwk: object | string): Promise<void>;
+/** Generates a new server key pair, sessions derived from the previous one stay valid for `grace` milliseconds. */
+export declare function rotateServerKey(grace?: number): Promise<void>;
 export declare function tunnel(req: any, res: any, next: any): void;
-export declare function _static(dir: any): (req: any, res: any, next: any) => void;
+export declare function tunnel(options?: TunnelOptions): (req: any, res: any, next: any) => void;
+export interface StaticOptions {
+    /**
+     * How the files and directories whose name starts with a dot are served: "allow",
+     * "deny" (403) or "ignore" (404, the default).
+     */
+    dotfiles?: "allow" | "deny" | "ignore";
+    /** The file, or the files in order, served for a directory; "index.html" by default, false for none. */
+    index?: string | string[] | false;
+    /** Redirects the directories requested without a trailing slash to the path with one, true by default. */
+    redirect?: boolean;
+    /** The extensions tried in order when no file matches the path, e.g. ["html"] serves /about.html for /about. */
+    extensions?: string[];
+    /**
+     * The URL path of the file served when no file matches, e.g. "/index.html" for the client
+     * side routes of a single page application. Paths ending with an extension still get a 404.
+     */
+    fallback?: string;
+    /**
+     * Content types by extension, e.g. { md: "text/markdown" }, over the built-in ones. Files
+     * with an unknown extension get the type sniffed from their content.
+     */
+    mimeTypes?: {
+        [extension: string]: string;
+    };
+    /**
+     * Keeps the contents of the files in memory, the least recently used are evicted first.
+     * A file modified on disk is read again. The cache holds up to "32mb" in 1000 files by default.
+     */
+    cache?: boolean | {
+        maxBytes?: number | string;
+        maxEntries?: number;
+    };
+}
+export declare function _static(dir: any, options?: StaticOptions): (req: any, res: any, next: any) => void;
 export { _static as static };
 export declare function multipart(options: any): {
     single: (name: any) => (req: any, res: any, next: any) => void;
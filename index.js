@@ -1,5 +1,6 @@
 // STEP 1: POLYFILL THE CRYPTO LIBRARY
 const fs = require('fs');
+const { Readable } = require('stream');
 const crypto = require("crypto").webcrypto;
 globalThis.crypto = crypto;
 
@@ -19,12 +20,48 @@ function decode(encoded) {
     return bytes.buffer;
 }
 
+// calls made before the WASM module is ready are queued until it is loaded
+let wasmLoaded = false;
+const onWASMLoaded = [];
+function whenLoaded(fn) {
+    if (wasmLoaded) {
+        fn();
+        return;
+    }
+    onWASMLoaded.push(fn);
+}
+
+// configure applies the options once the WASM module is loaded. The returned
+// state holds the configuration error, if any: the middleware then answers
+// every request with a 500 rather than serve it with the default settings.
+function configure(options) {
+    const state = { error: null };
+    whenLoaded(() => {
+        const err = ConfigureMiddleware(options, fs);
+        if (err) {
+            state.error = new Error("Layer8 middleware configuration failed: " + err);
+            console.error(state.error.message);
+        }
+    });
+    return state;
+}
+
+// configurationFailed answers a request like the internal errors of the middleware
+function configurationFailed(res) {
+    res.statusCode = 500;
+    res.setHeader("content-type", "application/json");
+    res.setHeader("x-layer8-error", "internal");
+    res.end(JSON.stringify({ error: "internal", message: "Internal server error" }));
+}
+
 // STEP 5: IMPORT
 const go = new Go();
 const importObject = go.importObject;
 WebAssembly.instantiate(decode(wasmBin), importObject).then(async (results) => {
     const instance = results.instance
     go.run(instance);
+    wasmLoaded = true;
+    onWASMLoaded.splice(0).forEach((fn) => fn());
     console.log("WASM is Loaded")
 }).catch((err)=>{
     console.log("Error running loadWASM script: ", err)
@@ -35,13 +72,60 @@ WebAssembly.instantiate(decode(wasmBin), importObject).then(async (results) => {
 //     WASMMiddleware(req, res, next);
 // };
 
+// loadServerKey replaces the server ECDH key pair with the given private
+// JWK (an object, JSON or base64 string). It resolves once the key is loaded.
+function loadServerKey(jwk) {
+    return new Promise((resolve, reject) => {
+        whenLoaded(() => {
+            const err = LoadServerKey(typeof jwk === "string" ? jwk : JSON.stringify(jwk));
+            if (err) {
+                reject(new Error("Layer8 server key could not be loaded: " + err));
+                return;
+            }
+            resolve();
+        });
+    });
+}
+
+// rotateServerKey generates a new server ECDH key pair, sessions derived from
+// the previous one stay valid for `grace` milliseconds (one hour by default).
+function rotateServerKey(grace) {
+    return new Promise((resolve, reject) => {
+        whenLoaded(() => {
+            const err = RotateServerKey(grace);
+            if (err) {
+                reject(new Error("Layer8 server key could not be rotated: " + err));
+                return;
+            }
+            resolve();
+        });
+    });
+}
+
 module.exports = {
-    tunnel: (req, res, next) => {
-        WASMMiddleware(req, res, next);
+    loadServerKey,
+    rotateServerKey,
+    // tunnel can be used directly as a middleware, `app.use(tunnel)`, or
+    // called with options to get a middleware, `app.use(tunnel({ store }))`
+    tunnel: function (req, res, next) {
+        if (arguments.length < 3) {
+            const config = configure(req || {});
+            return (req, res, next) => {
+                if (config.error) {
+                    configurationFailed(res);
+                    return;
+                }
+                WASMMiddleware(req, res, next, Readable);
+            };
+        }
+        WASMMiddleware(req, res, next, Readable);
     },
-    static: (dir) => {
+    static: (dir, options) => {
+        // the options are read, and the file cache created, once per mount
+        let serve;
         return (req, res, next) => {
-            ServeStatic(req, res, dir, fs);
+            serve = serve || ServeStatic(dir, fs, options);
+            serve(req, res);
         }
     },
     multipart: (options) => {
@@ -0,0 +1,119 @@
+package internals
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// ErrorCode identifies the cause of a tunnel failure. It is sent to the
+// interceptor in the x-layer8-error header and in the error body so that it
+// can tell a request to fix from a session to re-key.
+type ErrorCode string
+
+const (
+	CodeBadEnvelope    ErrorCode = "bad_envelope"
+	CodeTooLarge       ErrorCode = "too_large"
+	CodeBadHandshake   ErrorCode = "bad_handshake"
+	CodeInvalidJWT     ErrorCode = "invalid_jwt"
+	CodeDecryption     ErrorCode = "decryption_failed"
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	CodeReplay         ErrorCode = "replay"
+	CodeUnknownSession ErrorCode = "unknown_session"
+	CodeForbidden      ErrorCode = "forbidden"
+	CodeNotFound       ErrorCode = "not_found"
+	CodeInternal       ErrorCode = "internal"
+)
+
+// StatusSessionUnknown is the status of the requests whose session is unknown
+// or expired, the client has to redo the handshake
+const StatusSessionUnknown = 440
+
+// Error is a tunnel failure along with the HTTP status it is reported with
+type Error struct {
+	Code   ErrorCode
+	Status int
+	// Message is sent to the client, it must not leak internal details
+	Message string
+	// Err is the underlying error, it is only logged
+	Err error
+}
+
+var (
+	// ErrBadEnvelope is returned for request bodies that are not a {"data": "..."} envelope
+	ErrBadEnvelope = &Error{Code: CodeBadEnvelope, Status: http.StatusBadRequest, Message: "Malformed request envelope"}
+	// ErrTooLarge is returned for request bodies over the size limit
+	ErrTooLarge = &Error{Code: CodeTooLarge, Status: http.StatusRequestEntityTooLarge, Message: "Request body too large"}
+	// ErrBadHandshake is returned for handshakes with missing or invalid headers
+	ErrBadHandshake = &Error{Code: CodeBadHandshake, Status: http.StatusBadRequest, Message: "Malformed handshake"}
+	// ErrDecryption is returned when the envelope cannot be decrypted with the session key
+	ErrDecryption = &Error{Code: CodeDecryption, Status: http.StatusUnauthorized, Message: "Could not decrypt request"}
+	// ErrInvalidRequest is returned when the decrypted request is not a valid request
+	ErrInvalidRequest = &Error{Code: CodeInvalidRequest, Status: http.StatusUnprocessableEntity, Message: "Invalid request"}
+	// ErrReplay is returned for requests that were already processed, see ProcessOptions
+	ErrReplay = &Error{Code: CodeReplay, Status: http.StatusConflict, Message: "Replayed request"}
+	// ErrUnknownSession is returned when the client has no valid session
+	ErrUnknownSession = &Error{Code: CodeUnknownSession, Status: StatusSessionUnknown, Message: "Unknown or expired session"}
+	// ErrForbidden is returned for static files out of reach, see ResolveStaticPath
+	ErrForbidden = &Error{Code: CodeForbidden, Status: http.StatusForbidden, Message: "Forbidden"}
+	// ErrNotFound is returned for static files that do not exist or are hidden
+	ErrNotFound = &Error{Code: CodeNotFound, Status: http.StatusNotFound, Message: "Not Found"}
+	// ErrInternal is returned for failures of the middleware itself
+	ErrInternal = &Error{Code: CodeInternal, Status: http.StatusInternalServerError, Message: "Internal server error"}
+)
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an Error with the same code, so that
+// errors.Is(err, ErrReplay) holds for every replay error
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithMessage returns a copy of the error with a more specific message
+func (e *Error) WithMessage(message string) *Error {
+	c := *e
+	c.Message = message
+	return &c
+}
+
+// Wrap returns a copy of the error with err as the underlying error
+func (e *Error) Wrap(err error) *Error {
+	c := *e
+	c.Err = err
+	return &c
+}
+
+// Body returns the plaintext JSON error body sent to the client:
+//
+//	{"error": "<code>", "message": "<message>"}
+func (e *Error) Body() []byte {
+	b, _ := json.Marshal(map[string]string{
+		"error":   string(e.Code),
+		"message": e.Message,
+	})
+	return b
+}
+
+// AsError returns err as an *Error. A rejected mp-JWT is reported as a 401,
+// any other error as an internal error.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if errors.Is(err, ErrInvalidJWT) {
+		return &Error{Code: CodeInvalidJWT, Status: http.StatusUnauthorized, Message: "Invalid mp-JWT", Err: err}
+	}
+	return ErrInternal.Wrap(err)
+}
@@ -0,0 +1,52 @@
+package internals
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("cipher: message authentication failed")
+	err := ErrDecryption.Wrap(cause)
+
+	assert.True(t, errors.Is(err, ErrDecryption))
+	assert.False(t, errors.Is(err, ErrBadEnvelope))
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, "Could not decrypt request: cipher: message authentication failed", err.Error())
+
+	// copies do not alter the shared errors
+	custom := ErrBadEnvelope.WithMessage("Request body is empty")
+	assert.True(t, errors.Is(custom, ErrBadEnvelope))
+	assert.Equal(t, "Malformed request envelope", ErrBadEnvelope.Message)
+	assert.Nil(t, ErrDecryption.Err)
+
+	var body map[string]string
+	assert.Nil(t, json.Unmarshal(custom.Body(), &body))
+	assert.Equal(t, map[string]string{"error": "bad_envelope", "message": "Request body is empty"}, body)
+}
+
+func TestAsError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedCode   ErrorCode
+		expectedStatus int
+	}{
+		{"tunnel_error", ErrReplay, CodeReplay, 409},
+		{"wrapped_tunnel_error", fmt.Errorf("handling request: %w", ErrUnknownSession), CodeUnknownSession, StatusSessionUnknown},
+		{"invalid_jwt", fmt.Errorf("%w: token is expired", ErrInvalidJWT), CodeInvalidJWT, 401},
+		{"other_error", errors.New("boom"), CodeInternal, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := AsError(tt.err)
+			assert.Equal(t, tt.expectedCode, e.Code)
+			assert.Equal(t, tt.expectedStatus, e.Status)
+		})
+	}
+}
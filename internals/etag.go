@@ -0,0 +1,62 @@
+package internals
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag returns the strong entity tag of a static file, the hash of its
+// plaintext content: the encrypted responses differ at every request
+func ETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+}
+
+// NotModified reports whether the conditional headers of a decrypted request
+// match the current version of a static file, which is then answered with a
+// 304. If-None-Match takes precedence over If-Modified-Since, as in RFC 9110.
+//
+// Arguments:
+//   - method: the method of the request, only GET and HEAD are conditional
+//   - headers: the headers of the decrypted request
+//   - etag: the entity tag of the file, see ETag
+//   - modTime: the modification time of the file
+func NotModified(method string, headers map[string]string, etag string, modTime time.Time) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+
+	if match, ok := header(headers, "If-None-Match"); ok {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			// the weak comparison applies to If-None-Match
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if since, ok := header(headers, "If-Modified-Since"); ok && !modTime.IsZero() {
+		t, err := http.ParseTime(since)
+		if err != nil {
+			return false
+		}
+		// the header has a precision of one second
+		return !modTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// header returns the value of a header, case-insensitively
+func header(headers map[string]string, name string) (string, bool) {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
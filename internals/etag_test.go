@@ -0,0 +1,51 @@
+package internals
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETag(t *testing.T) {
+	etag := ETag([]byte("body{}"))
+	assert.Equal(t, etag, ETag([]byte("body{}")))
+	assert.NotEqual(t, etag, ETag([]byte("body{ }")))
+	assert.Regexp(t, `^"[A-Za-z0-9_-]{43}"$`, etag)
+}
+
+func TestNotModified(t *testing.T) {
+	etag := ETag([]byte("body{}"))
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	since := func(t time.Time) string { return t.Format(http.TimeFormat) }
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{"unconditional", "GET", map[string]string{}, false},
+		{"matching_etag", "GET", map[string]string{"If-None-Match": etag}, true},
+		{"lowercase_header", "GET", map[string]string{"if-none-match": etag}, true},
+		{"etag_in_list", "GET", map[string]string{"If-None-Match": `"other", ` + etag}, true},
+		{"weak_etag", "GET", map[string]string{"If-None-Match": "W/" + etag}, true},
+		{"wildcard", "GET", map[string]string{"If-None-Match": "*"}, true},
+		{"other_etag", "GET", map[string]string{"If-None-Match": `"other"`}, false},
+		{"head", "HEAD", map[string]string{"If-None-Match": etag}, true},
+		{"post", "POST", map[string]string{"If-None-Match": etag}, false},
+		{"not_modified_since", "GET", map[string]string{"If-Modified-Since": since(modTime)}, true},
+		{"not_modified_since_later", "GET", map[string]string{"If-Modified-Since": since(modTime.Add(time.Hour))}, true},
+		{"modified_since", "GET", map[string]string{"If-Modified-Since": since(modTime.Add(-time.Second))}, false},
+		{"invalid_date", "GET", map[string]string{"If-Modified-Since": "yesterday"}, false},
+		// If-None-Match takes precedence
+		{"other_etag_not_modified_since", "GET", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": since(modTime)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, NotModified(tt.method, tt.headers, etag, modTime))
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package internals
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"strings"
+	"time"
 
 	"globe-and-citizen/layer8/middleware/js"
 	"globe-and-citizen/layer8/middleware/storage"
@@ -10,17 +14,61 @@ import (
 	utils "github.com/globe-and-citizen/layer8-utils"
 )
 
+// Handshake is the outcome of a successful ECDH key exchange
+type Handshake struct {
+	// SharedSecret is the base64 encoded symmetric key
+	SharedSecret string
+	// PublicKey is the base64 encoded server public key
+	PublicKey string
+	// KeyID is the id of the server key pair used for the exchange
+	KeyID string
+	// MpJWT is the JWT presented by the client
+	MpJWT string
+	// KeyConfirmation proves that the server derived the same shared secret,
+	// see KeyConfirmation
+	KeyConfirmation string
+}
+
+// keyConfirmationLabel separates the key confirmation MAC from other uses of the shared secret
+const keyConfirmationLabel = "layer8-key-confirmation"
+
+// KeyConfirmation computes the key confirmation MAC of a handshake:
+//
+//	base64url(HMAC-SHA256(secret, label || 0x00 || clientUUID || 0x00 || clientPub || 0x00 || serverPub))
+//
+// where secret is the raw shared secret, label is "layer8-key-confirmation",
+// and clientPub and serverPub are the base64 public keys exchanged in the
+// x-ecdh-init header and in the response body. The client recomputes it with
+// its own shared secret to confirm the exchange without the secret ever being
+// sent.
+func KeyConfirmation(sharedSecret *utils.JWK, clientUUID, clientPub, serverPub string) (string, error) {
+	secret, err := base64.URLEncoding.DecodeString(sharedSecret.X)
+	if err != nil {
+		return "", errors.New("unable to decode shared secret: " + err.Error())
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	for i, part := range []string{keyConfirmationLabel, clientUUID, clientPub, serverPub} {
+		if i > 0 {
+			mac.Write([]byte{0})
+		}
+		mac.Write([]byte(part))
+	}
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
 // InitializeECDH initializes the ECDH key exchange
 //
 // Arguments:
 //   - request: the request object
+//   - verifier: validates the mp-JWT, any JWT is accepted when nil
 //
 // Returns:
-//   - sharedSecret: the shared secret
-//   - pub: the server public key
-//   - mpJWT: the JWT
-//   - error: an error if the function fails
-func InitializeECDH(headers *js.Value) (string, string, string, error) {
+//   - handshake: the shared secret and its key confirmation, the server public
+//     key and its id, and the JWT
+//   - error: an error if the function fails, ErrBadHandshake for invalid
+//     headers and an ErrInvalidJWT for a rejected mp-JWT
+func InitializeECDH(headers *js.Value, verifier *JWTVerifier) (*Handshake, error) {
 	db := storage.GetInMemStorage()
 
 	// validation
@@ -36,7 +84,7 @@ func InitializeECDH(headers *js.Value) (string, string, string, error) {
 		}
 	}
 	if len(missing) > 0 {
-		return "", "", "", errors.New("missing required headers: " + strings.Join(missing, ", "))
+		return nil, ErrBadHandshake.Wrap(errors.New("missing required headers: " + strings.Join(missing, ", ")))
 	}
 
 	invalid := []string{}
@@ -46,34 +94,66 @@ func InitializeECDH(headers *js.Value) (string, string, string, error) {
 		}
 	}
 	if len(invalid) > 0 {
-		return "", "", "", errors.New("invalid headers: " + strings.Join(invalid, ", "))
+		return nil, ErrBadHandshake.Wrap(errors.New("invalid headers: " + strings.Join(invalid, ", ")))
 	}
 
-	userPubJWK, err := utils.B64ToJWK(headers.Get("x-ecdh-init").(string))
+	clientPub := headers.Get("x-ecdh-init").(string)
+	userPubJWK, err := utils.B64ToJWK(clientPub)
 	if err != nil {
-		return "", "", "", errors.New("failure to decode userPubJWK: " + err.Error())
+		return nil, ErrBadHandshake.Wrap(errors.New("failure to decode userPubJWK: " + err.Error()))
 	}
 
 	clientUUID := headers.Get("x-client-uuid").(string)
+	mpJWT := headers.Get("mp-jwt").(string)
+
+	if verifier != nil {
+		if err := verifier.Verify(mpJWT, clientUUID); err != nil {
+			return nil, err
+		}
+	}
+
+	// read the key pair once as it may be rotated concurrently
+	serverPri, serverPub := db.ECDH.GetPrivateKey(), db.ECDH.GetPublicKey()
+	if serverPri == nil || serverPub == nil {
+		return nil, errors.New("server key pair is not configured")
+	}
 
-	ss, err := db.ECDH.GetPrivateKey().GetECDHSharedSecret(userPubJWK)
+	ss, err := serverPri.GetECDHSharedSecret(userPubJWK)
 	if err != nil {
-		return "", "", "", errors.New("unable to get ECDH shared secret: " + err.Error())
+		return nil, ErrBadHandshake.Wrap(errors.New("unable to get ECDH shared secret: " + err.Error()))
 	}
-	db.Keys.Add(clientUUID, ss)
 
 	sharedSecret, err := ss.ExportAsBase64()
 	if err != nil {
-		return "", "", "", errors.New("unable to export shared secret as base64: " + err.Error())
+		return nil, errors.New("unable to export shared secret as base64: " + err.Error())
 	}
 
-	pub, err := db.ECDH.GetPublicKey().ExportAsBase64()
+	pub, err := serverPub.ExportAsBase64()
 	if err != nil {
-		return "", "", "", errors.New("unable to export public key as base64: " + err.Error())
+		return nil, errors.New("unable to export public key as base64: " + err.Error())
 	}
 
-	mpJWT := headers.Get("mp-jwt").(string)
-	db.JWTs.Add(clientUUID, mpJWT)
+	confirmation, err := KeyConfirmation(ss, clientUUID, clientPub, pub)
+	if err != nil {
+		return nil, errors.New("unable to compute key confirmation: " + err.Error())
+	}
+
+	keyID := storage.KeyID(serverPub)
+	err = db.Sessions.Put(clientUUID, &storage.Session{
+		Key:     ss,
+		JWT:     mpJWT,
+		Created: time.Now(),
+		KeyID:   keyID,
+	})
+	if err != nil {
+		return nil, errors.New("unable to save session: " + err.Error())
+	}
 
-	return sharedSecret, pub, mpJWT, nil
+	return &Handshake{
+		SharedSecret:    sharedSecret,
+		PublicKey:       pub,
+		KeyID:           keyID,
+		MpJWT:           mpJWT,
+		KeyConfirmation: confirmation,
+	}, nil
 }
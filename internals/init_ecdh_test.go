@@ -1,12 +1,15 @@
 package internals
 
 import (
+	"errors"
 	"globe-and-citizen/layer8/middleware/js"
 	"globe-and-citizen/layer8/middleware/storage"
 	"strings"
 	"testing"
+	"time"
 
 	utilities "github.com/globe-and-citizen/layer8-utils"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -54,6 +57,7 @@ func TestInitializeECDH(t *testing.T) {
 		args          args
 		wantShared    string
 		wantPub       string
+		wantKeyID     string
 		wantMpJWT     string
 		wantErr       bool
 		wantErrString string
@@ -69,6 +73,7 @@ func TestInitializeECDH(t *testing.T) {
 			},
 			wantShared: b64Shared,
 			wantPub:    b64ServerPub,
+			wantKeyID:  storage.KeyID(serverPub),
 			wantMpJWT:  mpjwt,
 			wantErr:    false,
 		},
@@ -118,28 +123,123 @@ func TestInitializeECDH(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotShared, gotPub, gotMpJWT, err := InitializeECDH(tt.args.headers)
+			got, err := InitializeECDH(tt.args.headers, nil)
 			if tt.wantErr {
 				assert.NotNil(t, err)
 				assert.Subset(t, strings.Split(err.Error(), " "), strings.Split(tt.wantErrString, " "))
 			} else {
 				assert.Nil(t, err)
-				assert.Equal(t, tt.wantShared, gotShared)
-				assert.Equal(t, tt.wantPub, gotPub)
-				assert.Equal(t, tt.wantMpJWT, gotMpJWT)
+				assert.Equal(t, tt.wantShared, got.SharedSecret)
+				assert.Equal(t, tt.wantPub, got.PublicKey)
+				assert.Equal(t, tt.wantKeyID, got.KeyID)
+				assert.Equal(t, tt.wantMpJWT, got.MpJWT)
 
-				savedShared := db.Keys.Get(tt.args.headers.Get("x-client-uuid").(string))
-				assert.NotNil(t, savedShared)
+				// the client confirms the exchange with its own shared secret
+				clientShared, err := clientPri.GetECDHSharedSecret(serverPub)
+				assert.Nil(t, err)
+				confirmation, err := KeyConfirmation(clientShared, tt.args.headers.Get("x-client-uuid").(string), b64ClientPub, b64ServerPub)
+				assert.Nil(t, err)
+				assert.Equal(t, confirmation, got.KeyConfirmation)
 
-				b64Shared, err := savedShared.ExportAsBase64()
+				session, err := db.Sessions.Get(tt.args.headers.Get("x-client-uuid").(string))
+				assert.Nil(t, err)
+				assert.NotNil(t, session)
+
+				b64Shared, err := session.Key.ExportAsBase64()
 				assert.Nil(t, err)
 				assert.NotEmpty(t, b64Shared)
-				assert.Equal(t, b64Shared, gotShared)
+				assert.Equal(t, b64Shared, got.SharedSecret)
+				assert.Equal(t, tt.wantKeyID, session.KeyID)
 
-				savedMpJWT := db.JWTs.Get(tt.args.headers.Get("x-client-uuid").(string))
-				assert.NotEmpty(t, savedMpJWT)
-				assert.Equal(t, savedMpJWT, gotMpJWT)
+				assert.NotEmpty(t, session.JWT)
+				assert.Equal(t, session.JWT, got.MpJWT)
 			}
 		})
 	}
 }
+
+func TestKeyConfirmation(t *testing.T) {
+	pri, pub, err := utilities.GenerateKeyPair(utilities.ECDH)
+	assert.Nil(t, err)
+	shared, err := pri.GetECDHSharedSecret(pub)
+	assert.Nil(t, err)
+
+	pri2, pub2, err := utilities.GenerateKeyPair(utilities.ECDH)
+	assert.Nil(t, err)
+	shared2, err := pri2.GetECDHSharedSecret(pub2)
+	assert.Nil(t, err)
+
+	mac, err := KeyConfirmation(shared, "client", "client-pub", "server-pub")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, mac)
+
+	same, err := KeyConfirmation(shared, "client", "client-pub", "server-pub")
+	assert.Nil(t, err)
+	assert.Equal(t, mac, same)
+
+	// the MAC is bound to the secret and to every part of the exchange
+	for _, args := range [][4]interface{}{
+		{shared2, "client", "client-pub", "server-pub"},
+		{shared, "other", "client-pub", "server-pub"},
+		{shared, "client", "other-pub", "server-pub"},
+		{shared, "client", "client-pub", "other-pub"},
+		{shared, "clientclient-pub", "", "server-pub"},
+	} {
+		other, err := KeyConfirmation(args[0].(*utilities.JWK), args[1].(string), args[2].(string), args[3].(string))
+		assert.Nil(t, err)
+		assert.NotEqual(t, mac, other)
+	}
+
+	// the MAC does not reveal the secret
+	assert.NotContains(t, mac, shared.X)
+}
+
+func TestInitializeECDHVerifiesJWT(t *testing.T) {
+	serverPri, serverPub, err := utilities.GenerateKeyPair(utilities.ECDH)
+	assert.Nil(t, err)
+	storage.InitInMemStorage(serverPri, serverPub)
+
+	_, clientPub, err := utilities.GenerateKeyPair(utilities.ECDH)
+	assert.Nil(t, err)
+	b64ClientPub, err := clientPub.ExportAsBase64()
+	assert.Nil(t, err)
+
+	verifier, err := NewJWTVerifier("proxy-secret", "", nil, 0)
+	assert.Nil(t, err)
+
+	clientUUID := uuid.New().String()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": clientUUID,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("proxy-secret"))
+	assert.Nil(t, err)
+
+	// a token bound to the client is accepted
+	got, err := InitializeECDH(js.ValueOf(map[string]interface{}{
+		"x-ecdh-init":   b64ClientPub,
+		"x-client-uuid": clientUUID,
+		"mp-jwt":        token,
+	}), verifier)
+	assert.Nil(t, err)
+	assert.Equal(t, token, got.MpJWT)
+
+	// the same token cannot be used by another client and no session is created
+	otherUUID := uuid.New().String()
+	_, err = InitializeECDH(js.ValueOf(map[string]interface{}{
+		"x-ecdh-init":   b64ClientPub,
+		"x-client-uuid": otherUUID,
+		"mp-jwt":        token,
+	}), verifier)
+	assert.True(t, errors.Is(err, ErrInvalidJWT))
+
+	_, err = storage.GetInMemStorage().Sessions.Get(otherUUID)
+	assert.Equal(t, storage.ErrSessionNotFound, err)
+
+	// nor can an arbitrary string be registered as the JWT
+	_, err = InitializeECDH(js.ValueOf(map[string]interface{}{
+		"x-ecdh-init":   b64ClientPub,
+		"x-client-uuid": clientUUID,
+		"mp-jwt":        "anything",
+	}), verifier)
+	assert.True(t, errors.Is(err, ErrInvalidJWT))
+}
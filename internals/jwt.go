@@ -0,0 +1,104 @@
+package internals
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidJWT is returned when the mp-JWT presented during a handshake is rejected
+var ErrInvalidJWT = errors.New("invalid mp-JWT")
+
+// JWTVerifier validates the mp-JWT presented during the handshake. The token
+// must be signed with Secret (HMAC) or with the private key matching
+// PublicKey (ECDSA or RSA), must not be expired, and its subject must be the
+// client UUID of the handshake.
+type JWTVerifier struct {
+	// Secret verifies HS256/HS384/HS512 signatures
+	Secret []byte
+	// PublicKey verifies ES*/RS* signatures, an *ecdsa.PublicKey or *rsa.PublicKey
+	PublicKey interface{}
+	// Audience lists the accepted `aud` values, any audience is accepted when empty
+	Audience []string
+	// Leeway is the tolerated clock skew for `exp` and `nbf`
+	Leeway time.Duration
+
+	// methods are the signing algorithms of the key
+	methods []string
+	now     func() time.Time
+}
+
+// NewJWTVerifier creates a JWTVerifier from an HMAC secret or a PEM encoded
+// public key; exactly one of them must be given.
+func NewJWTVerifier(secret, publicKeyPEM string, audience []string, leeway time.Duration) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		Audience: audience,
+		Leeway:   leeway,
+		now:      time.Now,
+	}
+
+	switch {
+	case secret != "" && publicKeyPEM != "":
+		return nil, errors.New("either a secret or a public key must be given, not both")
+	case secret != "":
+		v.Secret = []byte(secret)
+		v.methods = []string{"HS256", "HS384", "HS512"}
+	case publicKeyPEM != "":
+		if key, err := jwt.ParseECPublicKeyFromPEM([]byte(publicKeyPEM)); err == nil {
+			v.PublicKey = key
+			v.methods = []string{"ES256", "ES384", "ES512"}
+		} else if key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(publicKeyPEM)); err == nil {
+			v.PublicKey = key
+			v.methods = []string{"RS256", "RS384", "RS512"}
+		} else {
+			return nil, errors.New("public key must be a PEM encoded ECDSA or RSA public key")
+		}
+	default:
+		return nil, errors.New("a secret or a public key is required to verify the mp-JWT")
+	}
+	return v, nil
+}
+
+// keyFunc returns the verification key, refusing algorithms that do not
+// match it so that a public key can never be used as an HMAC secret
+func (v *JWTVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if v.Secret != nil {
+			return v.Secret, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if key, ok := v.PublicKey.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodRSA:
+		if key, ok := v.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+}
+
+// Verify checks the signature and the claims of the token and that it was
+// issued for the client. The returned errors wrap ErrInvalidJWT.
+func (v *JWTVerifier) Verify(token, clientUUID string) error {
+	options := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.Leeway),
+		jwt.WithSubject(clientUUID),
+		jwt.WithValidMethods(v.methods),
+		jwt.WithTimeFunc(v.now),
+	}
+	if len(v.Audience) > 0 {
+		options = append(options, jwt.WithAudience(v.Audience...))
+	}
+
+	if _, err := jwt.NewParser(options...).Parse(token, v.keyFunc); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJWT, err.Error())
+	}
+	return nil
+}
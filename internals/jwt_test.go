@@ -0,0 +1,158 @@
+package internals
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTVerifier(t *testing.T) {
+	const (
+		secret     = "proxy-secret"
+		clientUUID = "client-uuid"
+	)
+	now := time.Now()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	assert.Nil(t, err)
+	publicKeyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		assert.Nil(t, err)
+		return token
+	}
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": clientUUID,
+			"aud": "layer8",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	hmacVerifier, err := NewJWTVerifier(secret, "", []string{"layer8"}, 30*time.Second)
+	assert.Nil(t, err)
+	hmacVerifier.now = func() time.Time { return now }
+
+	ecVerifier, err := NewJWTVerifier("", publicKeyPEM, nil, 0)
+	assert.Nil(t, err)
+	ecVerifier.now = func() time.Time { return now }
+
+	tests := []struct {
+		name          string
+		verifier      *JWTVerifier
+		token         string
+		wantErrString string
+	}{
+		{
+			name:     "verify_hmac_token",
+			verifier: hmacVerifier,
+			token:    sign(jwt.SigningMethodHS256, []byte(secret), claims(nil)),
+		},
+		{
+			name:     "verify_ecdsa_token",
+			verifier: ecVerifier,
+			token:    sign(jwt.SigningMethodES256, ecKey, claims(nil)),
+		},
+		{
+			name:     "verify_audience_list",
+			verifier: hmacVerifier,
+			token:    sign(jwt.SigningMethodHS256, []byte(secret), claims(jwt.MapClaims{"aud": []string{"other", "layer8"}})),
+		},
+		{
+			name:     "verify_expiry_within_leeway",
+			verifier: hmacVerifier,
+			token:    sign(jwt.SigningMethodHS256, []byte(secret), claims(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()})),
+		},
+		{
+			name:          "verify_wrong_secret",
+			verifier:      hmacVerifier,
+			token:         sign(jwt.SigningMethodHS256, []byte("other"), claims(nil)),
+			wantErrString: "signature is invalid",
+		},
+		{
+			name:          "verify_hmac_token_with_public_key",
+			verifier:      ecVerifier,
+			token:         sign(jwt.SigningMethodHS256, []byte(publicKeyPEM), claims(nil)),
+			wantErrString: "signing method HS256 is invalid",
+		},
+		{
+			name:          "verify_expired_token",
+			verifier:      hmacVerifier,
+			token:         sign(jwt.SigningMethodHS256, []byte(secret), claims(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()})),
+			wantErrString: "token is expired",
+		},
+		{
+			name:          "verify_token_without_expiry",
+			verifier:      hmacVerifier,
+			token:         sign(jwt.SigningMethodHS256, []byte(secret), claims(jwt.MapClaims{"exp": nil})),
+			wantErrString: "token is missing required claim: exp claim is required",
+		},
+		{
+			name:          "verify_token_not_valid_yet",
+			verifier:      hmacVerifier,
+			token:         sign(jwt.SigningMethodHS256, []byte(secret), claims(jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()})),
+			wantErrString: "token is not valid yet",
+		},
+		{
+			name:          "verify_wrong_audience",
+			verifier:      hmacVerifier,
+			token:         sign(jwt.SigningMethodHS256, []byte(secret), claims(jwt.MapClaims{"aud": "other"})),
+			wantErrString: "token has invalid audience",
+		},
+		{
+			name:          "verify_wrong_subject",
+			verifier:      hmacVerifier,
+			token:         sign(jwt.SigningMethodHS256, []byte(secret), claims(jwt.MapClaims{"sub": "other"})),
+			wantErrString: "token has invalid subject",
+		},
+		{
+			name:          "verify_malformed_token",
+			verifier:      hmacVerifier,
+			token:         "not-a-jwt",
+			wantErrString: "invalid mp-JWT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.verifier.Verify(tt.token, clientUUID)
+			if tt.wantErrString == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.NotNil(t, err)
+			assert.True(t, errors.Is(err, ErrInvalidJWT))
+			assert.Contains(t, err.Error(), tt.wantErrString)
+		})
+	}
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	_, err := NewJWTVerifier("", "", nil, 0)
+	assert.NotNil(t, err)
+
+	_, err = NewJWTVerifier("secret", "key", nil, 0)
+	assert.NotNil(t, err)
+
+	_, err = NewJWTVerifier("", "not a pem", nil, 0)
+	assert.NotNil(t, err)
+}
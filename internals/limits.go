@@ -0,0 +1,192 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultMaxBodySize is the largest decrypted request body accepted, in bytes
+	DefaultMaxBodySize = 10 << 20
+	// DefaultMaxFiles is the largest number of files accepted in a multipart request
+	DefaultMaxFiles = 20
+	// DefaultMaxFileSize is the largest file accepted in a multipart request, in bytes
+	DefaultMaxFileSize = 10 << 20
+)
+
+// Limits bounds the size of the requests, the zero fields use the defaults
+type Limits struct {
+	// MaxEnvelopeSize is the largest encrypted request body, DefaultMaxEnvelopeSize
+	MaxEnvelopeSize int
+	// MaxBodySize is the largest decrypted request body, DefaultMaxBodySize
+	MaxBodySize int
+	// MaxFiles is the largest number of files of a multipart request, DefaultMaxFiles
+	MaxFiles int
+	// MaxFileSize is the largest file of a multipart request, DefaultMaxFileSize
+	MaxFileSize int
+}
+
+// EnvelopeSize returns the largest encrypted request body accepted
+func (l Limits) EnvelopeSize() int {
+	return orDefault(l.MaxEnvelopeSize, DefaultMaxEnvelopeSize)
+}
+
+// BodySize returns the largest decrypted request body accepted
+func (l Limits) BodySize() int {
+	return orDefault(l.MaxBodySize, DefaultMaxBodySize)
+}
+
+// Files returns the largest number of files accepted in a multipart request
+func (l Limits) Files() int {
+	return orDefault(l.MaxFiles, DefaultMaxFiles)
+}
+
+// FileSize returns the largest file accepted in a multipart request
+func (l Limits) FileSize() int {
+	return orDefault(l.MaxFileSize, DefaultMaxFileSize)
+}
+
+// Override returns the limits with the non-zero fields of o
+func (l Limits) Override(o Limits) Limits {
+	if o.MaxEnvelopeSize > 0 {
+		l.MaxEnvelopeSize = o.MaxEnvelopeSize
+	}
+	if o.MaxBodySize > 0 {
+		l.MaxBodySize = o.MaxBodySize
+	}
+	if o.MaxFiles > 0 {
+		l.MaxFiles = o.MaxFiles
+	}
+	if o.MaxFileSize > 0 {
+		l.MaxFileSize = o.MaxFileSize
+	}
+	return l
+}
+
+// Check returns an ErrTooLarge when the encrypted or the decrypted body of a
+// request is over the limits
+func (l Limits) Check(envelopeSize, bodySize int) error {
+	if envelopeSize > l.EnvelopeSize() {
+		return ErrTooLarge.WithMessage(fmt.Sprintf("Request body exceeds %d bytes", l.EnvelopeSize()))
+	}
+	if bodySize > l.BodySize() {
+		return ErrTooLarge.WithMessage(fmt.Sprintf("Decrypted request body exceeds %d bytes", l.BodySize()))
+	}
+	return nil
+}
+
+// CheckFiles returns an ErrTooLarge when a multipart request has more files
+// than the limit
+func (l Limits) CheckFiles(files int) error {
+	if files > l.Files() {
+		return ErrTooLarge.WithMessage(fmt.Sprintf("Request has more than %d files", l.Files()))
+	}
+	return nil
+}
+
+// CheckFileSize returns an ErrTooLarge when a file of a multipart request is
+// over the limit
+func (l Limits) CheckFileSize(size int) error {
+	if size > l.FileSize() {
+		return ErrTooLarge.WithMessage(fmt.Sprintf("File exceeds %d bytes", l.FileSize()))
+	}
+	return nil
+}
+
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// RouteLimits are the limits of every request, overridden for some routes
+type RouteLimits struct {
+	Limits
+	// Routes overrides the limits of the URL paths under a prefix, e.g.
+	// "/upload" for "/upload" and "/upload/avatar" but not "/uploads". The
+	// longest matching prefix applies, its zero fields use Limits.
+	Routes map[string]Limits
+}
+
+// For returns the limits of the request to urlPath, its query aside
+func (r *RouteLimits) For(urlPath string) Limits {
+	if i := strings.IndexAny(urlPath, "?#"); i >= 0 {
+		urlPath = urlPath[:i]
+	}
+
+	var (
+		limits = r.Limits
+		match  = -1
+	)
+	for prefix, route := range r.Routes {
+		if len(prefix) <= match || !underPrefix(urlPath, prefix) {
+			continue
+		}
+		limits, match = r.Limits.Override(route), len(prefix)
+	}
+	return limits
+}
+
+// MaxEnvelopeSize returns the largest encrypted request body accepted by any
+// route, the limit while the body is received: the URL path of the request is
+// only known once it is decrypted
+func (r *RouteLimits) MaxEnvelopeSize() int {
+	size := r.EnvelopeSize()
+	for _, route := range r.Routes {
+		if s := r.Limits.Override(route).EnvelopeSize(); s > size {
+			size = s
+		}
+	}
+	return size
+}
+
+// underPrefix reports whether urlPath is prefix or a path under it
+func underPrefix(urlPath, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(urlPath, prefix) {
+		return false
+	}
+	return len(urlPath) == len(prefix) || urlPath[len(prefix)] == '/'
+}
+
+// sizeUnits are the units of ParseSize, in powers of 1024
+var sizeUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+	"tb": 1 << 40,
+}
+
+// ParseSize parses a size in bytes written as body-parser accepts it: a
+// number of bytes, or a number followed by a unit among b, kb, mb, gb and tb
+// (case-insensitive, in powers of 1024), e.g. "512kb" or "1.5mb"
+func ParseSize(s string) (int, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(value)
+	}
+
+	unit, ok := sizeUnits[strings.TrimSpace(value[i:])]
+	if !ok {
+		return 0, errors.New("invalid size unit in " + strconv.Quote(s))
+	}
+	n, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, errors.New("invalid size " + strconv.Quote(s))
+	}
+
+	size := math.Floor(n * unit)
+	if size >= math.MaxInt64 {
+		return 0, errors.New("size " + strconv.Quote(s) + " is too large")
+	}
+	return int(size), nil
+}
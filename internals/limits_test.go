@@ -0,0 +1,93 @@
+package internals
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"100b", 100, false},
+		{"512kb", 512 << 10, false},
+		{"10mb", 10 << 20, false},
+		{"10MB", 10 << 20, false},
+		{"1.5mb", 3 << 19, false},
+		{" 2 gb ", 2 << 30, false},
+		{"1tb", 1 << 40, false},
+		{"", 0, true},
+		{"mb", 0, true},
+		{"10xb", 0, true},
+		{"1.2.3kb", 0, true},
+		{"-1kb", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseSize(tt.value)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRouteLimits(t *testing.T) {
+	limits := &RouteLimits{
+		Limits: Limits{MaxBodySize: 1 << 20},
+		Routes: map[string]Limits{
+			"/upload":        {MaxBodySize: 100 << 20, MaxEnvelopeSize: 200 << 20},
+			"/upload/avatar": {MaxFileSize: 1 << 20},
+			"/api/":          {MaxFiles: 1},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		urlPath string
+		want    Limits
+	}{
+		{"global", "/", Limits{MaxBodySize: 1 << 20}},
+		{"route", "/upload", Limits{MaxBodySize: 100 << 20, MaxEnvelopeSize: 200 << 20}},
+		{"route_with_query", "/upload?name=a", Limits{MaxBodySize: 100 << 20, MaxEnvelopeSize: 200 << 20}},
+		{"path_under_route", "/upload/file", Limits{MaxBodySize: 100 << 20, MaxEnvelopeSize: 200 << 20}},
+		{"longest_prefix", "/upload/avatar", Limits{MaxBodySize: 1 << 20, MaxFileSize: 1 << 20}},
+		{"other_path_with_the_prefix", "/uploads", Limits{MaxBodySize: 1 << 20}},
+		{"route_with_trailing_slash", "/api/users", Limits{MaxBodySize: 1 << 20, MaxFiles: 1}},
+		{"route_with_trailing_slash_itself", "/api", Limits{MaxBodySize: 1 << 20, MaxFiles: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, limits.For(tt.urlPath))
+		})
+	}
+
+	assert.Equal(t, 200<<20, limits.MaxEnvelopeSize())
+	assert.Equal(t, DefaultMaxEnvelopeSize, new(RouteLimits).MaxEnvelopeSize())
+}
+
+func TestLimitsCheck(t *testing.T) {
+	limits := Limits{MaxEnvelopeSize: 100, MaxBodySize: 50, MaxFiles: 2, MaxFileSize: 10}
+
+	assert.Nil(t, limits.Check(100, 50))
+	assert.True(t, errors.Is(limits.Check(101, 0), ErrTooLarge))
+	assert.True(t, errors.Is(limits.Check(0, 51), ErrTooLarge))
+	assert.Nil(t, limits.CheckFiles(2))
+	assert.True(t, errors.Is(limits.CheckFiles(3), ErrTooLarge))
+	assert.Nil(t, limits.CheckFileSize(10))
+	assert.True(t, errors.Is(limits.CheckFileSize(11), ErrTooLarge))
+
+	// zero limits use the defaults
+	assert.Nil(t, Limits{}.Check(DefaultMaxEnvelopeSize, DefaultMaxBodySize))
+	assert.True(t, errors.Is(Limits{}.Check(0, DefaultMaxBodySize+1), ErrTooLarge))
+}
@@ -0,0 +1,78 @@
+package internals
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// mimeTypes are the content types of the static files by extension. Browsers
+// check the types of stylesheets, module scripts and WebAssembly modules, so
+// they cannot be left to http.DetectContentType.
+var mimeTypes = map[string]string{
+	".avif":        "image/avif",
+	".bmp":         "image/bmp",
+	".cjs":         "text/javascript; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".eot":         "application/vnd.ms-fontobject",
+	".gif":         "image/gif",
+	".gz":          "application/gzip",
+	".htm":         "text/html; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/vnd.microsoft.icon",
+	".jpeg":        "image/jpeg",
+	".jpg":         "image/jpeg",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json; charset=utf-8",
+	".jsonld":      "application/ld+json",
+	".map":         "application/json; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".mp3":         "audio/mpeg",
+	".mp4":         "video/mp4",
+	".oga":         "audio/ogg",
+	".ogg":         "audio/ogg",
+	".ogv":         "video/ogg",
+	".otf":         "font/otf",
+	".pdf":         "application/pdf",
+	".png":         "image/png",
+	".svg":         "image/svg+xml",
+	".tar":         "application/x-tar",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".wav":         "audio/wav",
+	".weba":        "audio/webm",
+	".webm":        "video/webm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "application/xml; charset=utf-8",
+	".zip":         "application/zip",
+}
+
+// ContentType returns the content type of a static file from its extension,
+// looked up in overrides then in the built-in table, and sniffed from its
+// content with http.DetectContentType for unknown extensions.
+//
+// Arguments:
+//   - name: the path of the file
+//   - content: the content of the file, or at least its first 512 bytes
+//   - overrides: content types by extension, with or without the leading
+//     dot, taking precedence over the built-in table
+func ContentType(name string, content []byte, overrides map[string]string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext != "" {
+		for k, v := range overrides {
+			if strings.EqualFold("."+strings.TrimPrefix(k, "."), ext) {
+				return v
+			}
+		}
+		if t, ok := mimeTypes[ext]; ok {
+			return t
+		}
+	}
+	return http.DetectContentType(content)
+}
@@ -0,0 +1,42 @@
+package internals
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	overrides := map[string]string{
+		"md":    "text/x-markdown",
+		".Wasm": "application/x-wasm",
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		content []byte
+		want    string
+	}{
+		{"stylesheet", "public/css/site.css", []byte("body{}"), "text/css; charset=utf-8"},
+		{"module_script", "app.mjs", []byte("export {}"), "text/javascript; charset=utf-8"},
+		{"script", "app.js", []byte("console.log(1)"), "text/javascript; charset=utf-8"},
+		{"svg", "logo.svg", []byte("<svg></svg>"), "image/svg+xml"},
+		{"json", "data.json", []byte("{}"), "application/json; charset=utf-8"},
+		{"uppercase_extension", "INDEX.HTML", []byte("hi"), "text/html; charset=utf-8"},
+		{"extension_over_content", "image.jpg", png, "image/jpeg"},
+		{"unknown_extension", "image.bin", png, "image/png"},
+		{"no_extension", "LICENSE", []byte("MIT License"), "text/plain; charset=utf-8"},
+		{"override", "README.md", []byte("# hi"), "text/x-markdown"},
+		{"override_with_dot", "main.wasm", []byte("\x00asm"), "application/x-wasm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ContentType(tt.file, tt.content, overrides))
+		})
+	}
+
+	assert.Equal(t, "application/wasm", ContentType("main.wasm", nil, nil))
+}
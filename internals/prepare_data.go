@@ -2,53 +2,105 @@ package internals
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"strings"
 
 	"globe-and-citizen/layer8/middleware/js"
 
 	utils "github.com/globe-and-citizen/layer8-utils"
 )
 
-func PrepareData(res, data *js.Value, symmKey *utils.JWK, jwt string) *utils.Response {
-	var (
-		b   []byte
-		err error
-	)
+// Response is the response encrypted by PrepareData. Besides the fields of
+// utils.Response, it carries every value of the headers set several times,
+// such as Set-Cookie, whose values cannot be joined into a single one.
+type Response struct {
+	utils.Response
+	MultiHeaders map[string][]string `json:"multi_headers,omitempty"`
+}
+
+// PrepareData encrypts the response of a route handler
+//
+// Arguments:
+//   - res: the response object, for its statusCode, statusText and headers;
+//     a header with an array value is joined with ", " in the headers and
+//     kept as a list in the multi_headers of the encrypted response
+//   - data: the body of the response
+//   - symmKey: the symmetric key of the session
+//   - jwt: the mp-JWT of the session
+//
+// Returns:
+//   - response: the encrypted response and the headers to send it with
+//   - error: an ErrInternal if the response cannot be encoded or encrypted
+func PrepareData(res, data *js.Value, symmKey *utils.JWK, jwt string) (*utils.Response, error) {
+	b, err := EncodeBody(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt response
+	jres := NewResponse(res)
+	jres.Body = b
+
+	// binary bodies are sent as they are, the interceptor rebuilds a Blob of
+	// their content-type
+	if data.Type == js.TypeBinary && !hasHeader(jres.Headers, "content-type") {
+		jres.Headers["content-type"] = http.DetectContentType(b)
+	}
+
+	b, err = json.Marshal(jres)
+	if err != nil {
+		return nil, ErrInternal.Wrap(errors.New("error serializing json response: " + err.Error()))
+	}
+
+	b, err = symmKey.SymmetricEncrypt(b)
+	if err != nil {
+		return nil, ErrInternal.Wrap(errors.New("error encrypting response: " + err.Error()))
+	}
+
+	return &utils.Response{
+		Body:       b,
+		Status:     jres.Status,
+		StatusText: jres.StatusText,
+		Headers: map[string]string{
+			"content-type": "application/json",
+			"mp-JWT":       jwt,
+		},
+	}, nil
+}
 
+// EncodeBody returns the bytes of a response body: objects and arrays are
+// encoded as JSON, numbers as JSON.stringify does and binary data as it is
+func EncodeBody(data *js.Value) ([]byte, error) {
 	switch data.Type {
-	case js.TypeObject:
-		b, err = json.Marshal(data.GetValue().(map[string]interface{}))
-		if err != nil {
-			println("error serializing json response:", err.Error())
-			return &utils.Response{
-				Status:     500,
-				StatusText: "Could not encode response",
-			}
-		}
-	case js.TypeArray:
-		b, err = json.Marshal(data.GetValue().([]interface{}))
+	case js.TypeObject, js.TypeArray:
+		b, err := json.Marshal(jsonSafe(data.GetValue()))
 		if err != nil {
-			println("error serializing json response:", err.Error())
-			return &utils.Response{
-				Status:     500,
-				StatusText: "Could not encode response",
-			}
+			return nil, ErrInternal.Wrap(errors.New("error serializing json response: " + err.Error()))
 		}
+		return b, nil
 	case js.TypeString:
-		b = []byte(data.String())
+		return []byte(data.String()), nil
 	case js.TypeNumber:
-		b = []byte(fmt.Sprintf("%f", data.Number()))
+		return []byte(formatNumber(data.Number())), nil
 	case js.TypeBoolean:
-		b = []byte(fmt.Sprintf("%t", data.Bool()))
-	default:
-		b = []byte(fmt.Sprintf("%v", data.GetValue()))
+		return []byte(fmt.Sprintf("%t", data.Bool())), nil
+	case js.TypeBinary:
+		return data.Bytes(), nil
 	}
+	return []byte(fmt.Sprintf("%v", data.GetValue())), nil
+}
 
-	// Encrypt response
-	jres := utils.Response{
-		Body:    b,
-		Status:  200,
-		Headers: make(map[string]string),
+// NewResponse returns the status and the headers of the response object,
+// without body; see PrepareData for the headers
+func NewResponse(res *js.Value) *Response {
+	jres := &Response{
+		Response: utils.Response{
+			Status:  200,
+			Headers: make(map[string]string),
+		},
 	}
 	if res.Get("statusCode") != nil {
 		jres.Status = int(res.Get("statusCode").(float64))
@@ -61,37 +113,86 @@ func PrepareData(res, data *js.Value, symmKey *utils.JWK, jwt string) *utils.Res
 		res.Set("headers", map[string]*js.Value{})
 	}
 	for k, v := range res.Get("headers").(map[string]*js.Value) {
-		if v.Type != js.TypeString {
+		if v.Type != js.TypeArray {
+			if value, ok := headerValue(v); ok {
+				jres.Headers[k] = value
+			}
 			continue
 		}
-		jres.Headers[k] = v.Value.(string)
-	}
 
-	b, err = jres.ToJSON()
-	if err != nil {
-		println("error serializing json response:", err.Error())
-		return &utils.Response{
-			Status:     500,
-			StatusText: "Could not encode response",
+		values := []string{}
+		for _, e := range v.Value.([]*js.Value) {
+			if value, ok := headerValue(e); ok {
+				values = append(values, value)
+			}
 		}
+		if len(values) == 0 {
+			continue
+		}
+		jres.Headers[k] = strings.Join(values, ", ")
+		if jres.MultiHeaders == nil {
+			jres.MultiHeaders = make(map[string][]string)
+		}
+		jres.MultiHeaders[k] = values
+	}
+	return jres
+}
+
+// headerValue returns the string value of a header, headers such as
+// content-length may be set as numbers
+func headerValue(v *js.Value) (string, bool) {
+	switch v.Type {
+	case js.TypeString:
+		return v.String(), true
+	case js.TypeNumber:
+		return formatNumber(v.Number()), true
 	}
+	return "", false
+}
 
-	b, err = symmKey.SymmetricEncrypt(b)
-	if err != nil {
-		println("error encrypting response:", err.Error())
-		return &utils.Response{
-			Status:     500,
-			StatusText: "Could not encrypt response",
+// hasHeader reports whether the headers contain name, case-insensitively
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
 		}
 	}
+	return false
+}
+
+// formatNumber formats a number as JSON.stringify does. encoding/json already
+// formats floats as ES6 does; NaN and the infinities become null and -0
+// becomes 0.
+func formatNumber(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "null"
+	}
+	if f == 0 {
+		return "0"
+	}
+	b, _ := json.Marshal(f)
+	return string(b)
+}
 
-	return &utils.Response{
-		Body:       b,
-		Status:     jres.Status,
-		StatusText: jres.StatusText,
-		Headers: map[string]string{
-			"content-type": "application/json",
-			"mp-JWT":       jwt,
-		},
+// jsonSafe replaces, in place, the numbers encoding/json cannot marshal the
+// way JSON.stringify would
+func jsonSafe(v interface{}) interface{} {
+	switch val := v.(type) {
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil
+		}
+		if val == 0 {
+			return float64(0)
+		}
+	case map[string]interface{}:
+		for k, e := range val {
+			val[k] = jsonSafe(e)
+		}
+	case []interface{}:
+		for i, e := range val {
+			val[i] = jsonSafe(e)
+		}
 	}
+	return v
 }
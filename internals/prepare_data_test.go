@@ -1,7 +1,9 @@
 package internals
 
 import (
+	"encoding/json"
 	"globe-and-citizen/layer8/middleware/js"
+	"math"
 	"testing"
 
 	utils "github.com/globe-and-citizen/layer8-utils"
@@ -115,11 +117,99 @@ func TestPrepareData(t *testing.T) {
 				Headers:    map[string]string{},
 			},
 		},
+		{
+			name: "prepare_data_with_binary_body",
+			data: js.ValueOf([]byte("\x89PNG\r\n\x1a\n\x00\xff")),
+			res: js.ValueOf(map[string]interface{}{
+				"statusCode": float64(200),
+				"statusText": "OK",
+				"headers":    map[string]interface{}{},
+			}),
+			want: &utils.Response{
+				Body:       []byte("\x89PNG\r\n\x1a\n\x00\xff"),
+				Status:     200,
+				StatusText: "OK",
+				Headers: map[string]string{
+					"content-type": "image/png",
+				},
+			},
+		},
+		{
+			name: "prepare_data_with_binary_body_and_content_type",
+			data: js.ValueOf([]byte("%PDF-1.7\n\x00\xff")),
+			res: js.ValueOf(map[string]interface{}{
+				"statusCode": float64(200),
+				"statusText": "OK",
+				"headers": map[string]interface{}{
+					"Content-Type": "application/x-custom",
+				},
+			}),
+			want: &utils.Response{
+				Body:       []byte("%PDF-1.7\n\x00\xff"),
+				Status:     200,
+				StatusText: "OK",
+				Headers: map[string]string{
+					"Content-Type": "application/x-custom",
+				},
+			},
+		},
+		{
+			name: "prepare_data_with_unknown_binary_body",
+			data: js.ValueOf([]byte{0x00, 0x01, 0x02, 0xfe}),
+			res: js.ValueOf(map[string]interface{}{
+				"statusCode": float64(200),
+				"statusText": "OK",
+				"headers":    map[string]interface{}{},
+			}),
+			want: &utils.Response{
+				Body:       []byte{0x00, 0x01, 0x02, 0xfe},
+				Status:     200,
+				StatusText: "OK",
+				Headers: map[string]string{
+					"content-type": "application/octet-stream",
+				},
+			},
+		},
+		{
+			name: "prepare_data_with_number_body",
+			data: js.ValueOf(float64(42)),
+			res: js.ValueOf(map[string]interface{}{
+				"statusCode": float64(200),
+				"statusText": "OK",
+				"headers":    map[string]interface{}{},
+			}),
+			want: &utils.Response{
+				Body:       []byte("42"),
+				Status:     200,
+				StatusText: "OK",
+				Headers:    map[string]string{},
+			},
+		},
+		{
+			name: "prepare_data_with_non_finite_numbers",
+			data: js.ValueOf(map[string]interface{}{
+				"a": math.NaN(),
+				"b": []interface{}{float64(1), math.Inf(1), math.Copysign(0, -1), 2.5},
+				"c": map[string]interface{}{"d": 1e21},
+			}),
+			res: js.ValueOf(map[string]interface{}{
+				"statusCode": float64(200),
+				"statusText": "OK",
+				"headers":    map[string]interface{}{},
+			}),
+			want: &utils.Response{
+				Body:       []byte(`{"a":null,"b":[1,null,0,2.5],"c":{"d":1e+21}}`),
+				Status:     200,
+				StatusText: "OK",
+				Headers:    map[string]string{},
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			response := PrepareData(tt.res, tt.data, key, "test_mp_jwt")
+			response, err := PrepareData(tt.res, tt.data, key, "test_mp_jwt")
+			assert.Nil(t, err)
 			assert.NotNil(t, response)
 			assert.Equal(t, int(tt.res.Get("statusCode").(float64)), response.Status)
 			assert.Equal(t, tt.res.Get("statusText").(string), response.StatusText)
@@ -133,3 +223,84 @@ func TestPrepareData(t *testing.T) {
 		})
 	}
 }
+
+func TestPrepareDataHeaders(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	key, err := pri.GetECDHSharedSecret(pub)
+	assert.Nil(t, err)
+
+	res := js.ValueOf(map[string]interface{}{
+		"statusCode": float64(302),
+		"statusText": "Found",
+		"headers": map[string]interface{}{
+			"location":       "/login",
+			"content-length": float64(2),
+			"set-cookie": []interface{}{
+				"session=abc; Path=/; Expires=Wed, 21 Oct 2026 07:28:00 GMT; HttpOnly",
+				"theme=dark",
+			},
+			"x-ignored": map[string]interface{}{},
+		},
+	})
+
+	response, err := PrepareData(res, js.ValueOf("ok"), key, "test_mp_jwt")
+	assert.Nil(t, err)
+
+	b, err := key.SymmetricDecrypt(response.Body)
+	assert.Nil(t, err)
+
+	var got Response
+	assert.Nil(t, json.Unmarshal(b, &got))
+	assert.Equal(t, 302, got.Status)
+	assert.Equal(t, map[string]string{
+		"location":       "/login",
+		"content-length": "2",
+		"set-cookie":     "session=abc; Path=/; Expires=Wed, 21 Oct 2026 07:28:00 GMT; HttpOnly, theme=dark",
+	}, got.Headers)
+	assert.Equal(t, map[string][]string{
+		"set-cookie": {
+			"session=abc; Path=/; Expires=Wed, 21 Oct 2026 07:28:00 GMT; HttpOnly",
+			"theme=dark",
+		},
+	}, got.MultiHeaders)
+}
+
+func TestFormatNumber(t *testing.T) {
+	// the expected values are the output of JSON.stringify in Node.js
+	tests := []struct {
+		number float64
+		want   string
+	}{
+		{0, "0"},
+		{math.Copysign(0, -1), "0"},
+		{42, "42"},
+		{-7, "-7"},
+		{100, "100"},
+		{3.14, "3.14"},
+		{0.30000000000000004, "0.30000000000000004"},
+		{1.0 / 3, "0.3333333333333333"},
+		{1e20, "100000000000000000000"},
+		{1e21, "1e+21"},
+		{123456789012345680000, "123456789012345680000"},
+		{1e-6, "0.000001"},
+		{0.000001234, "0.000001234"},
+		{1e-7, "1e-7"},
+		{-1.5e-9, "-1.5e-9"},
+		{123e-20, "1.23e-18"},
+		{1 << 53, "9007199254740992"},
+		{1<<53 + 2, "9007199254740994"},
+		{1<<53 - 1, "9007199254740991"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{5e-324, "5e-324"},
+		{math.NaN(), "null"},
+		{math.Inf(1), "null"},
+		{math.Inf(-1), "null"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, formatNumber(tt.number))
+		})
+	}
+}
@@ -4,47 +4,148 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	utils "github.com/globe-and-citizen/layer8-utils"
 )
 
-// ProcessData decodes and decrypts the request body. It returns a Response object
-// and a Request object. When the Response object is not nil, it means that an error
-// occurred and the request should be stopped.
-func ProcessData(rawdata string, key *utils.JWK) (*utils.Response, *utils.Request) {
-	response := new(utils.Response)
+// DefaultMaxEnvelopeSize is the largest encrypted request body accepted by
+// ProcessData, in bytes
+const DefaultMaxEnvelopeSize = 10 << 20
+
+// minCiphertextSize is the size of an empty AES-GCM ciphertext: the nonce
+// followed by the authentication tag
+const minCiphertextSize = 12 + 16
+
+// DefaultMaxClockSkew is the accepted difference between the timestamp of a
+// request and the server clock when replay protection is enabled
+const DefaultMaxClockSkew = 5 * time.Minute
+
+// ReplayChecker records the sequence numbers accepted for a session, e.g. a
+// *storage.ReplayWindow
+type ReplayChecker interface {
+	// Accept records the sequence number and reports whether it is new
+	Accept(seq uint64) bool
+}
+
+// ProcessOptions tunes the checks done by ProcessData
+type ProcessOptions struct {
+	// Replay records the sequence numbers of the session. When set, the
+	// decrypted request must carry a sequence number ("seq") that was not
+	// accepted before and a timestamp in milliseconds ("ts") close to the
+	// server clock.
+	Replay ReplayChecker
+	// MaxClockSkew bounds the age of the request timestamp, DefaultMaxClockSkew
+	// when zero
+	MaxClockSkew time.Duration
+	// MaxEnvelopeSize is the largest accepted request body in bytes,
+	// DefaultMaxEnvelopeSize when zero
+	MaxEnvelopeSize int
+	// Limits bounds the body of streamed requests, see RequestStream; the
+	// default limits apply when nil
+	Limits *RouteLimits
+
+	now func() time.Time
+}
+
+// sequencing holds the replay protection fields of a decrypted request
+type sequencing struct {
+	Seq       uint64 `json:"seq"`
+	Timestamp int64  `json:"ts"`
+}
+
+// ProcessData decodes and decrypts the request body.
+//
+// Arguments:
+//   - rawdata: the encrypted request body
+//   - key: the symmetric key of the session
+//   - options: the size limit and the replay protection settings, nil uses
+//     the default size limit without replay protection
+//
+// Returns:
+//   - request: the decrypted request
+//   - error: an *Error describing why the request was rejected
+func ProcessData(rawdata string, key *utils.JWK, options *ProcessOptions) (*utils.Request, error) {
+	maxSize := DefaultMaxEnvelopeSize
+	if options != nil && options.MaxEnvelopeSize > 0 {
+		maxSize = options.MaxEnvelopeSize
+	}
+	if len(rawdata) > maxSize {
+		return nil, ErrTooLarge.WithMessage(fmt.Sprintf("Request body exceeds %d bytes", maxSize))
+	}
+	if len(rawdata) == 0 {
+		return nil, ErrBadEnvelope.WithMessage("Request body is empty")
+	}
 
 	// parse body and decrypt the "data" field
-	var enc map[string]interface{}
-	json.Unmarshal([]byte(rawdata), &enc)
+	var enc struct {
+		Data *json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(rawdata), &enc); err != nil {
+		return nil, ErrBadEnvelope.WithMessage("Request body is not a JSON object").Wrap(err)
+	}
+	var encoded string
+	if enc.Data == nil || json.Unmarshal(*enc.Data, &encoded) != nil || encoded == "" {
+		return nil, ErrBadEnvelope.WithMessage("Request body is missing the \"data\" string")
+	}
 
-	data, err := base64.URLEncoding.DecodeString(enc["data"].(string))
+	data, err := base64.URLEncoding.DecodeString(encoded)
 	if err != nil {
-		fmt.Println("error decoding request:", err.Error())
-		response.Status = 500
-		response.StatusText = "Could not decode request: " + err.Error()
-		return response, nil
+		return nil, ErrBadEnvelope.WithMessage("Could not decode request").Wrap(err)
+	}
+	if len(data) < minCiphertextSize {
+		return nil, ErrBadEnvelope.WithMessage("Request data is too short")
 	}
 
 	b, err := key.SymmetricDecrypt(data)
 	if err != nil {
-		fmt.Println("error decrypting request:", err.Error())
-		response.Status = 500
-		response.StatusText = "Could not decrypt request: " + err.Error()
-		return response, nil
+		return nil, ErrDecryption.Wrap(err)
 	}
 
 	// parse the decrypted data into a request object
 	jreq, err := utils.FromJSONRequest(b)
 	if err != nil {
-		fmt.Println("error serializing json request:", err.Error())
-		response.Status = 500
-		response.StatusText = "Could not decode request: " + err.Error()
-		return response, nil
+		return nil, ErrInvalidRequest.WithMessage("Could not decode request").Wrap(err)
+	}
+	if jreq.Method == "" {
+		return nil, ErrInvalidRequest.WithMessage("Request is missing its method")
 	}
 	if jreq.Headers == nil {
 		jreq.Headers = make(map[string]string)
 	}
 
-	return nil, jreq
+	if options != nil && options.Replay != nil {
+		if err := checkReplay(b, options); err != nil {
+			return nil, err
+		}
+	}
+
+	return jreq, nil
+}
+
+// checkReplay validates the sequence number and the timestamp of the
+// decrypted request
+func checkReplay(b []byte, options *ProcessOptions) error {
+	var seq sequencing
+	if err := json.Unmarshal(b, &seq); err != nil || seq.Seq == 0 || seq.Timestamp == 0 {
+		return ErrInvalidRequest.WithMessage("Request is missing its sequence number or timestamp")
+	}
+
+	now := time.Now
+	if options.now != nil {
+		now = options.now
+	}
+	skew := options.MaxClockSkew
+	if skew <= 0 {
+		skew = DefaultMaxClockSkew
+	}
+	if diff := now().Sub(time.UnixMilli(seq.Timestamp)); diff > skew || diff < -skew {
+		return ErrReplay.WithMessage("Request timestamp outside the accepted window")
+	}
+
+	// the window is only updated once the other checks passed
+	if !options.Replay.Accept(seq.Seq) {
+		return ErrReplay
+	}
+	return nil
 }
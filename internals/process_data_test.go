@@ -3,7 +3,12 @@ package internals
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"globe-and-citizen/layer8/middleware/storage"
 
 	utils "github.com/globe-and-citizen/layer8-utils"
 	"github.com/stretchr/testify/assert"
@@ -56,7 +61,7 @@ func TestProcessData(t *testing.T) {
 		key          *utils.JWK
 		rawData      string
 		expectedBody []byte
-		expectError  bool // if true, a response object is returned
+		expectError  bool // if true, an error is returned
 	}{
 		{
 			name: "process_data_with_valid_key",
@@ -93,15 +98,128 @@ func TestProcessData(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			response, request := ProcessData(tt.rawData, tt.key)
+			request, err := ProcessData(tt.rawData, tt.key, nil)
 			if tt.expectError {
-				assert.NotNil(t, response)
+				assert.True(t, errors.Is(err, ErrDecryption))
 				assert.Nil(t, request)
 			} else {
-				assert.Nil(t, response)
+				assert.Nil(t, err)
 				assert.NotNil(t, request)
 				assert.Equal(t, tt.expectedBody, request.Body)
 			}
 		})
 	}
 }
+
+// encryptRaw wraps the encrypted data in a request envelope
+func encryptRaw(t *testing.T, key *utils.JWK, data []byte) string {
+	enc, err := key.SymmetricEncrypt(data)
+	assert.Nil(t, err)
+
+	b, err := json.Marshal(map[string]string{
+		"data": base64.URLEncoding.EncodeToString(enc),
+	})
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestProcessDataMalformedEnvelope(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	shared, err := pri.GetECDHSharedSecret(pub)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name          string
+		rawData       string
+		options       *ProcessOptions
+		expectedError *Error
+	}{
+		{"empty_body", "", nil, ErrBadEnvelope},
+		{"not_json", "GET / HTTP/1.1", nil, ErrBadEnvelope},
+		{"json_array", `["data"]`, nil, ErrBadEnvelope},
+		{"missing_data", `{"foo":"bar"}`, nil, ErrBadEnvelope},
+		{"null_data", `{"data":null}`, nil, ErrBadEnvelope},
+		{"non_string_data", `{"data":42}`, nil, ErrBadEnvelope},
+		{"invalid_base64", `{"data":"%%%"}`, nil, ErrBadEnvelope},
+		{"short_data", `{"data":"AAAA"}`, nil, ErrBadEnvelope},
+		{"data_without_tag", `{"data":"` + base64.URLEncoding.EncodeToString(make([]byte, 27)) + `"}`, nil, ErrBadEnvelope},
+		{"undecryptable_data", `{"data":"` + base64.URLEncoding.EncodeToString(make([]byte, 64)) + `"}`, nil, ErrDecryption},
+		{"not_a_request", encryptRaw(t, shared, []byte("[]")), nil, ErrInvalidRequest},
+		{"missing_method", encryptRaw(t, shared, []byte(`{"headers":{}}`)), nil, ErrInvalidRequest},
+		{"oversize_body", `{"data":"` + strings.Repeat("A", 64) + `"}`, &ProcessOptions{MaxEnvelopeSize: 32}, ErrTooLarge},
+		{"oversize_body_default", `{"data":"` + strings.Repeat("A", DefaultMaxEnvelopeSize) + `"}`, nil, ErrTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := ProcessData(tt.rawData, shared, tt.options)
+			assert.Nil(t, request)
+			assert.True(t, errors.Is(err, tt.expectedError))
+			assert.Equal(t, tt.expectedError.Status, AsError(err).Status)
+		})
+	}
+}
+
+func TestProcessDataReplay(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	shared, err := pri.GetECDHSharedSecret(pub)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	encrypt := func(seq uint64, ts time.Time) string {
+		req := map[string]interface{}{
+			"method":  "GET",
+			"headers": map[string]string{},
+			"body":    []byte("{}"),
+		}
+		if seq != 0 {
+			req["seq"] = seq
+			req["ts"] = ts.UnixMilli()
+		}
+		b, err := json.Marshal(req)
+		assert.Nil(t, err)
+		return encryptRaw(t, shared, b)
+	}
+
+	options := &ProcessOptions{
+		Replay:       new(storage.ReplayWindow),
+		MaxClockSkew: time.Minute,
+		now:          func() time.Time { return now },
+	}
+
+	tests := []struct {
+		name          string
+		rawData       string
+		expectedError *Error // nil when the request is accepted
+	}{
+		{"first_request", encrypt(1, now), nil},
+		{"replayed_request", encrypt(1, now), ErrReplay},
+		{"out_of_order_request", encrypt(3, now), nil},
+		{"late_request_within_window", encrypt(2, now.Add(-30*time.Second)), nil},
+		{"stale_timestamp", encrypt(4, now.Add(-2*time.Minute)), ErrReplay},
+		{"future_timestamp", encrypt(5, now.Add(2*time.Minute)), ErrReplay},
+		{"missing_sequence", encrypt(0, now), ErrInvalidRequest},
+		// rejected requests do not consume their sequence number
+		{"retried_request", encrypt(4, now), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := ProcessData(tt.rawData, shared, options)
+			if tt.expectedError == nil {
+				assert.Nil(t, err)
+				assert.NotNil(t, request)
+			} else {
+				assert.True(t, errors.Is(err, tt.expectedError))
+				assert.Nil(t, request)
+			}
+		})
+	}
+
+	// without options, sequencing is not required
+	request, err := ProcessData(encrypt(0, now), shared, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, request)
+}
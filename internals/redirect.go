@@ -0,0 +1,40 @@
+package internals
+
+import (
+	"errors"
+	"net/url"
+)
+
+// ResolveRedirect resolves the location of a redirect against the URL path
+// of the request, the way a browser resolves a relative Location header.
+// The location "back" is the referrer of the request, or "/" without one.
+//
+// Arguments:
+//   - urlPath: the __url_path of the request, e.g. "/users/42?tab=profile"
+//   - location: the location given to res.redirect
+//   - referrer: the Referer header of the request
+//
+// Returns:
+//   - location: the resolved location, a path unless location was absolute
+//   - error: an error if the URL path or the location cannot be parsed
+func ResolveRedirect(urlPath, location, referrer string) (string, error) {
+	if location == "back" {
+		location = referrer
+		if location == "" {
+			location = "/"
+		}
+	}
+	if urlPath == "" {
+		urlPath = "/"
+	}
+
+	base, err := url.Parse(urlPath)
+	if err != nil {
+		return "", errors.New("invalid url path: " + err.Error())
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", errors.New("invalid redirect location: " + err.Error())
+	}
+	return base.ResolveReference(ref).String(), nil
+}
@@ -0,0 +1,43 @@
+package internals
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		urlPath  string
+		location string
+		referrer string
+		want     string
+		wantErr  bool
+	}{
+		{"absolute_path", "/users/42", "/login", "", "/login", false},
+		{"relative_path", "/users/42/edit?tab=profile", "../43", "", "/users/43", false},
+		{"sibling_path", "/auth/callback", "done", "", "/auth/done", false},
+		{"query_only", "/search?q=a", "?q=b", "", "/search?q=b", false},
+		{"keeps_query", "/auth/callback?code=1", "/home?welcome=1#top", "", "/home?welcome=1#top", false},
+		{"absolute_url", "/auth/callback", "https://accounts.example.com/authorize?state=x", "", "https://accounts.example.com/authorize?state=x", false},
+		{"protocol_relative_url", "/a", "//cdn.example.com/x", "", "//cdn.example.com/x", false},
+		{"escapes_location", "/a", "/files/my report.pdf", "", "/files/my%20report.pdf", false},
+		{"back_with_referrer", "/logout", "back", "https://app.example.com/settings", "https://app.example.com/settings", false},
+		{"back_without_referrer", "/logout", "back", "", "/", false},
+		{"empty_url_path", "", "next", "", "/next", false},
+		{"invalid_location", "/a", "http://[::1", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveRedirect(tt.urlPath, tt.location, tt.referrer)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
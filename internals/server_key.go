@@ -0,0 +1,128 @@
+package internals
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+)
+
+// ParseServerKey parses the server ECDH private key and derives its public key.
+//
+// The key is a P-256 JWK given either as JSON or as the base64 encoding of the
+// JSON. Coordinates may be base64url encoded with or without padding. When the
+// JWK has no key id, one is derived from the public key so that every replica
+// loading the same key reports the same id.
+//
+// Returns:
+//   - pri: the private key
+//   - pub: the public key
+//   - error: an error if the key is invalid
+func ParseServerKey(raw string) (*utils.JWK, *utils.JWK, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil, errors.New("server key is empty")
+	}
+
+	b := []byte(raw)
+	if !strings.HasPrefix(raw, "{") {
+		var err error
+		b, err = decodeBase64(raw)
+		if err != nil {
+			return nil, nil, errors.New("server key is neither JSON nor base64: " + err.Error())
+		}
+	}
+
+	// JWKs exported by other libraries name the operations "key_ops"
+	var jwk struct {
+		utils.JWK
+		KeyOps []string `json:"key_ops"`
+	}
+	if err := json.Unmarshal(b, &jwk); err != nil {
+		return nil, nil, errors.New("server key is not a valid JWK: " + err.Error())
+	}
+	pri := jwk.JWK
+	pri.Key_ops = append(pri.Key_ops, jwk.KeyOps...)
+
+	if pri.Kty != "EC" || pri.Crv != "P-256" {
+		return nil, nil, errors.New("server key must be an EC P-256 key")
+	}
+	if pri.D == "" {
+		return nil, nil, errors.New("server key must be a private key")
+	}
+	if len(pri.Key_ops) == 0 {
+		pri.Key_ops = []string{"deriveKey"}
+	}
+	if !slices.Contains(pri.Key_ops, "deriveKey") {
+		return nil, nil, errors.New("server key must allow the deriveKey operation")
+	}
+
+	d, err := decodeCoordinate(pri.D)
+	if err != nil {
+		return nil, nil, errors.New("invalid d coordinate: " + err.Error())
+	}
+	x, err := decodeCoordinate(pri.X)
+	if err != nil {
+		return nil, nil, errors.New("invalid x coordinate: " + err.Error())
+	}
+	y, err := decodeCoordinate(pri.Y)
+	if err != nil {
+		return nil, nil, errors.New("invalid y coordinate: " + err.Error())
+	}
+
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, nil, errors.New("invalid private key: " + err.Error())
+	}
+	point := key.PublicKey().Bytes() // 0x04 || X || Y
+	if !bytes.Equal(point[1:33], x) || !bytes.Equal(point[33:], y) {
+		return nil, nil, errors.New("public coordinates do not match the private key")
+	}
+
+	id := strings.TrimPrefix(pri.Kid, "priv_")
+	if id == "" {
+		sum := sha256.Sum256(point)
+		id = base64.URLEncoding.EncodeToString(sum[:16])
+	}
+
+	// re-encode the coordinates the way the utils package expects them
+	pri.D = base64.URLEncoding.EncodeToString(key.Bytes())
+	pri.X = base64.URLEncoding.EncodeToString(x)
+	pri.Y = base64.URLEncoding.EncodeToString(y)
+	pri.Kid = "priv_" + id
+
+	pub := &utils.JWK{
+		Key_ops: []string{"deriveKey"},
+		Kty:     pri.Kty,
+		Kid:     "pub_" + id,
+		Crv:     pri.Crv,
+		X:       pri.X,
+		Y:       pri.Y,
+	}
+	return &pri, pub, nil
+}
+
+// decodeBase64 decodes standard or URL base64, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// decodeCoordinate decodes a 32 bytes P-256 coordinate, restoring leading zeros
+func decodeCoordinate(s string) ([]byte, error) {
+	b, err := decodeBase64(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 32 {
+		return nil, errors.New("coordinate is longer than 32 bytes")
+	}
+	return append(make([]byte, 32-len(b)), b...), nil
+}
@@ -0,0 +1,150 @@
+package internals
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServerKey(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+
+	b64Pri, err := pri.ExportAsBase64()
+	assert.Nil(t, err)
+
+	jsonPri, err := json.Marshal(pri)
+	assert.Nil(t, err)
+
+	// a JWK as exported by WebCrypto: key_ops and unpadded coordinates
+	webCryptoPri, err := json.Marshal(map[string]interface{}{
+		"kty":     "EC",
+		"crv":     "P-256",
+		"key_ops": []string{"deriveKey", "deriveBits"},
+		"d":       strings.TrimRight(pri.D, "="),
+		"x":       strings.TrimRight(pri.X, "="),
+		"y":       strings.TrimRight(pri.Y, "="),
+	})
+	assert.Nil(t, err)
+
+	_, otherPub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	mismatched := *pri
+	mismatched.X = otherPub.X
+	mismatchedJSON, err := json.Marshal(mismatched)
+	assert.Nil(t, err)
+
+	pubJSON, err := json.Marshal(pub)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name          string
+		raw           string
+		wantKid       bool
+		wantErrString string
+	}{
+		{
+			name:    "parse_base64_key",
+			raw:     b64Pri,
+			wantKid: true,
+		},
+		{
+			name:    "parse_json_key",
+			raw:     string(jsonPri),
+			wantKid: true,
+		},
+		{
+			name: "parse_webcrypto_key",
+			raw:  string(webCryptoPri),
+		},
+		{
+			name: "parse_std_base64_key",
+			raw:  base64.StdEncoding.EncodeToString(webCryptoPri),
+		},
+		{
+			name:          "parse_empty_key",
+			raw:           " ",
+			wantErrString: "server key is empty",
+		},
+		{
+			name:          "parse_invalid_json",
+			raw:           "{not json",
+			wantErrString: "server key is not a valid JWK",
+		},
+		{
+			name:          "parse_public_key",
+			raw:           string(pubJSON),
+			wantErrString: "server key must be a private key",
+		},
+		{
+			name:          "parse_mismatched_key",
+			raw:           string(mismatchedJSON),
+			wantErrString: "public coordinates do not match the private key",
+		},
+		{
+			name:          "parse_wrong_curve",
+			raw:           `{"kty":"EC","crv":"P-384","d":"AA","x":"AA","y":"AA"}`,
+			wantErrString: "server key must be an EC P-256 key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPri, gotPub, err := ParseServerKey(tt.raw)
+			if tt.wantErrString != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.wantErrString)
+				return
+			}
+			assert.Nil(t, err)
+			// compare decoded coordinates as utils drops their leading zeros
+			for _, c := range [][2]string{{pri.D, gotPri.D}, {pub.X, gotPub.X}, {pub.Y, gotPub.Y}} {
+				want, err := decodeCoordinate(c[0])
+				assert.Nil(t, err)
+				got, err := decodeCoordinate(c[1])
+				assert.Nil(t, err)
+				assert.Equal(t, want, got)
+			}
+			assert.Empty(t, gotPub.D)
+			if tt.wantKid {
+				assert.Equal(t, pri.Kid, gotPri.Kid)
+				assert.Equal(t, pub.Kid, gotPub.Kid)
+			}
+
+			// the parsed pair performs the same key exchange as the original one
+			clientPri, clientPub, err := utils.GenerateKeyPair(utils.ECDH)
+			assert.Nil(t, err)
+
+			want, err := pri.GetECDHSharedSecret(clientPub)
+			assert.Nil(t, err)
+			got, err := gotPri.GetECDHSharedSecret(clientPub)
+			assert.Nil(t, err)
+			assert.Equal(t, want.X, got.X)
+
+			fromClient, err := clientPri.GetECDHSharedSecret(gotPub)
+			assert.Nil(t, err)
+			assert.Equal(t, want.X, fromClient.X)
+		})
+	}
+}
+
+func TestParseServerKeyDerivesStableKid(t *testing.T) {
+	pri, _, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	pri.Kid = ""
+
+	b, err := json.Marshal(pri)
+	assert.Nil(t, err)
+
+	first, _, err := ParseServerKey(string(b))
+	assert.Nil(t, err)
+	second, _, err := ParseServerKey(string(b))
+	assert.Nil(t, err)
+
+	assert.NotEmpty(t, first.Kid)
+	assert.Equal(t, first.Kid, second.Kid)
+}
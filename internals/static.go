@@ -0,0 +1,170 @@
+package internals
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Dotfiles is how static serving treats the files and directories whose name
+// starts with a dot, such as .env or .git
+type Dotfiles string
+
+const (
+	// DotfilesAllow serves dotfiles like any other file
+	DotfilesAllow Dotfiles = "allow"
+	// DotfilesDeny answers the requests for dotfiles with a 403
+	DotfilesDeny Dotfiles = "deny"
+	// DotfilesIgnore answers the requests for dotfiles with a 404, as if they
+	// did not exist
+	DotfilesIgnore Dotfiles = "ignore"
+)
+
+// ResolveStaticPath returns the path of the file under root requested by
+// urlPath. The URL path is unescaped once and cleaned, it cannot leave root.
+//
+// Arguments:
+//   - root: the directory of the static files
+//   - urlPath: the path of the request, its query is ignored
+//   - dotfiles: how to treat the dotfiles, DotfilesIgnore when empty
+//
+// Returns:
+//   - path: the path of the file, root joined with the cleaned URL path
+//   - error: an ErrInvalidRequest for URL paths that cannot be unescaped or
+//     contain a NUL byte, an ErrForbidden for URL paths with a ".." segment
+//     and for denied dotfiles, an ErrNotFound for ignored dotfiles
+func ResolveStaticPath(root, urlPath string, dotfiles Dotfiles) (string, error) {
+	if i := strings.IndexAny(urlPath, "?#"); i >= 0 {
+		urlPath = urlPath[:i]
+	}
+
+	p, err := url.PathUnescape(urlPath)
+	if err != nil {
+		return "", ErrInvalidRequest.WithMessage("Invalid URL path").Wrap(err)
+	}
+	if strings.ContainsRune(p, 0) {
+		return "", ErrInvalidRequest.WithMessage("Invalid URL path")
+	}
+
+	// a ".." segment, including an escaped one or one written with the
+	// Windows separator, is an attempt to leave root
+	segments := strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' })
+	for _, segment := range segments {
+		if segment == ".." {
+			return "", ErrForbidden
+		}
+	}
+
+	p = path.Clean("/" + strings.Join(segments, "/"))
+	if dotfiles != DotfilesAllow {
+		for _, segment := range strings.Split(p, "/") {
+			if !strings.HasPrefix(segment, ".") {
+				continue
+			}
+			if dotfiles == DotfilesDeny {
+				return "", ErrForbidden
+			}
+			return "", ErrNotFound
+		}
+	}
+
+	resolved := path.Join(root, p)
+	if !WithinRoot(root, resolved) {
+		return "", ErrForbidden
+	}
+	return resolved, nil
+}
+
+// WithinRoot reports whether p is root or a path under it. Both paths are
+// compared once cleaned, symbolic links are not resolved.
+func WithinRoot(root, p string) bool {
+	root, p = path.Clean(root), path.Clean(p)
+	if root == "." {
+		return !path.IsAbs(p) && p != ".." && !strings.HasPrefix(p, "../")
+	}
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
+
+// StaticOptions tunes how FindStaticFile maps URL paths to files
+type StaticOptions struct {
+	// Dotfiles is how to treat the dotfiles, see ResolveStaticPath
+	Dotfiles Dotfiles
+	// Index are the files served for a directory, in order, e.g. index.html
+	Index []string
+	// Redirect redirects the requests for a directory without a trailing
+	// slash to the path with one, so that relative links resolve in it
+	Redirect bool
+	// Extensions are tried in order when no file matches the path, e.g. "html"
+	// serves /about.html for /about
+	Extensions []string
+	// Fallback is the URL path of the file served when no file matches, e.g.
+	// /index.html for the client side routes of a single page application.
+	// It is not served for paths whose last segment has an extension, which
+	// are missing assets rather than routes.
+	Fallback string
+}
+
+// StaticFS is the file system FindStaticFile looks the files up in. Its
+// lookups may block the calling goroutine, e.g. awaiting a promise of the
+// Node fs module, so FindStaticFile then runs in a goroutine of its own.
+type StaticFS interface {
+	// Stat reports whether the path exists and whether it is a directory
+	Stat(path string) (exists, dir bool)
+}
+
+// StaticFile is the result of FindStaticFile: the path of the file to
+// serve, or the URL path to redirect to
+type StaticFile struct {
+	Path     string
+	Redirect string
+}
+
+// FindStaticFile returns the file under root to serve for urlPath, see
+// StaticOptions. It returns the errors of ResolveStaticPath, and an
+// ErrNotFound when no file matches.
+func FindStaticFile(fsys StaticFS, root, urlPath string, options StaticOptions) (*StaticFile, error) {
+	p, err := ResolveStaticPath(root, urlPath, options.Dotfiles)
+	if err != nil {
+		return nil, err
+	}
+
+	pathPart, query := urlPath, ""
+	if i := strings.IndexAny(urlPath, "?#"); i >= 0 {
+		pathPart, query = urlPath[:i], urlPath[i:]
+	}
+
+	exists, dir := fsys.Stat(p)
+	switch {
+	case exists && !dir && !strings.HasSuffix(pathPart, "/"):
+		return &StaticFile{Path: p}, nil
+	case dir:
+		if !strings.HasSuffix(pathPart, "/") && options.Redirect {
+			return &StaticFile{Redirect: pathPart + "/" + query}, nil
+		}
+		for _, index := range options.Index {
+			if file := path.Join(p, index); isFile(fsys, file) {
+				return &StaticFile{Path: file}, nil
+			}
+		}
+	case !strings.HasSuffix(pathPart, "/"):
+		for _, ext := range options.Extensions {
+			if file := p + "." + strings.TrimPrefix(ext, "."); isFile(fsys, file) {
+				return &StaticFile{Path: file}, nil
+			}
+		}
+	}
+
+	if options.Fallback != "" && path.Ext(pathPart) == "" {
+		fallback, err := ResolveStaticPath(root, options.Fallback, DotfilesAllow)
+		if err == nil && isFile(fsys, fallback) {
+			return &StaticFile{Path: fallback}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// isFile reports whether the path is a file
+func isFile(fsys StaticFS, p string) bool {
+	exists, dir := fsys.Stat(p)
+	return exists && !dir
+}
@@ -0,0 +1,142 @@
+package internals
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveStaticPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		urlPath       string
+		dotfiles      Dotfiles
+		want          string
+		expectedError *Error
+	}{
+		{"file", "/index.html", "", "public/index.html", nil},
+		{"nested_file", "/css/site.css", "", "public/css/site.css", nil},
+		{"query", "/index.html?v=2", "", "public/index.html", nil},
+		{"escaped_characters", "/my%20file+1.txt", "", "public/my file+1.txt", nil},
+		{"duplicate_slashes", "//css//site.css", "", "public/css/site.css", nil},
+		{"dot_segments", "/css/./site.css", "", "public/css/site.css", nil},
+		{"parent_segment", "/../../etc/passwd", "", "", ErrForbidden},
+		{"escaped_parent_segment", "/%2e%2e%2f%2e%2e%2fetc/passwd", "", "", ErrForbidden},
+		{"parent_segment_inside_root", "/css/../index.html", "", "", ErrForbidden},
+		{"windows_parent_segment", "/..%5c..%5cetc/passwd", "", "", ErrForbidden},
+		{"nul_byte", "/index.html%00.png", "", "", ErrInvalidRequest},
+		{"invalid_escape", "/%zz", "", "", ErrInvalidRequest},
+		{"ignored_dotfile", "/.env", "", "", ErrNotFound},
+		{"ignored_dot_directory", "/.git/config", DotfilesIgnore, "", ErrNotFound},
+		{"denied_dotfile", "/.env", DotfilesDeny, "", ErrForbidden},
+		{"allowed_dotfile", "/.well-known/security.txt", DotfilesAllow, "public/.well-known/security.txt", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveStaticPath("public", tt.urlPath, tt.dotfiles)
+			if tt.expectedError != nil {
+				assert.True(t, errors.Is(err, tt.expectedError), "got %v", err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWithinRoot(t *testing.T) {
+	tests := []struct {
+		root string
+		path string
+		want bool
+	}{
+		{"/srv/public", "/srv/public", true},
+		{"/srv/public", "/srv/public/index.html", true},
+		{"/srv/public/", "/srv/public/css/site.css", true},
+		{"/srv/public", "/srv/public-private/key.pem", false},
+		{"/srv/public", "/srv/public/../private/key.pem", false},
+		{"/srv/public", "/etc/passwd", false},
+		{"/", "/etc/passwd", true},
+		{".", "index.html", true},
+		{".", "../index.html", false},
+		{".", "/etc/passwd", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.root+"|"+tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, WithinRoot(tt.root, tt.path))
+		})
+	}
+}
+
+// fakeFS is a StaticFS of the given files, their directories exist too
+type fakeFS map[string]bool
+
+func (f fakeFS) Stat(p string) (exists, dir bool) {
+	if f[p] {
+		return true, false
+	}
+	for file := range f {
+		if strings.HasPrefix(file, p+"/") {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func TestFindStaticFile(t *testing.T) {
+	fsys := fakeFS{
+		"public/index.html":        true,
+		"public/about.html":        true,
+		"public/docs/index.htm":    true,
+		"public/blog/readme.txt":   true,
+		"public/css/site.css":      true,
+		"public/data.json":         true,
+		"public/.well-known/x.txt": true,
+	}
+	defaults := StaticOptions{Index: []string{"index.html", "index.htm"}, Redirect: true}
+	spa := StaticOptions{Index: []string{"index.html"}, Redirect: true, Extensions: []string{"html", ".json"}, Fallback: "/index.html"}
+
+	tests := []struct {
+		name          string
+		urlPath       string
+		options       StaticOptions
+		want          *StaticFile
+		expectedError *Error
+	}{
+		{"file", "/css/site.css", defaults, &StaticFile{Path: "public/css/site.css"}, nil},
+		{"root_index", "/", defaults, &StaticFile{Path: "public/index.html"}, nil},
+		{"directory_index", "/docs/", defaults, &StaticFile{Path: "public/docs/index.htm"}, nil},
+		{"directory_redirect", "/docs", defaults, &StaticFile{Redirect: "/docs/"}, nil},
+		{"directory_redirect_keeps_query", "/docs?page=2", defaults, &StaticFile{Redirect: "/docs/?page=2"}, nil},
+		{"directory_without_redirect", "/docs", StaticOptions{Index: []string{"index.htm"}}, &StaticFile{Path: "public/docs/index.htm"}, nil},
+		{"directory_without_index", "/blog/", defaults, nil, ErrNotFound},
+		{"no_index", "/", StaticOptions{}, nil, ErrNotFound},
+		{"file_with_trailing_slash", "/about.html/", defaults, nil, ErrNotFound},
+		{"missing_file", "/about", defaults, nil, ErrNotFound},
+		{"extension", "/about", spa, &StaticFile{Path: "public/about.html"}, nil},
+		{"extension_with_dot", "/data", spa, &StaticFile{Path: "public/data.json"}, nil},
+		{"fallback", "/users/42", spa, &StaticFile{Path: "public/index.html"}, nil},
+		{"fallback_for_directory_without_index", "/blog/", spa, &StaticFile{Path: "public/index.html"}, nil},
+		{"no_fallback_for_assets", "/css/missing.css", spa, nil, ErrNotFound},
+		{"missing_fallback", "/users/42", StaticOptions{Fallback: "/app.html"}, nil, ErrNotFound},
+		{"traversal", "/../secret", spa, nil, ErrForbidden},
+		{"ignored_dotfile", "/.well-known/x.txt", spa, nil, ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindStaticFile(fsys, "public", tt.urlPath, tt.options)
+			if tt.expectedError != nil {
+				assert.True(t, errors.Is(err, tt.expectedError), "got %v", err)
+				assert.Nil(t, got)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
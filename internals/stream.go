@@ -0,0 +1,365 @@
+package internals
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"globe-and-citizen/layer8/middleware/js"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Bodies too large to be encrypted in a single envelope are streamed in
+// frames, each sealed with AES-GCM under a key of its own stream:
+//
+//	stream = "L8S1" || salt (32 bytes) || frame || frame ...
+//	frame  = header (4 bytes) || ciphertext
+//
+// The key of a stream is derived from the session key with HKDF-SHA256 over
+// the random salt of the stream, so that the frame counters of the streams
+// of a session, in both directions, never share a nonce under one key.
+//
+// The header is the length of the ciphertext, big-endian, with its high bit
+// set on the last frame of the stream. Frame i is sealed with the nonce
+// 0 (4 bytes) || uint64(i) and the additional data uint64(i) || final, where
+// final is 1 for the last frame and 0 otherwise, so that reordered, replayed
+// or dropped frames and truncated streams fail to open.
+//
+// The first frame of a stream holds its metadata as JSON: the request, with
+// its __url_path and without body, or the response, without body. The other
+// frames hold the body.
+const (
+	// StreamHeader is the header asking for, and marking, a streamed body
+	StreamHeader = "x-layer8-stream"
+	// StreamChunkSize is the largest plaintext sealed in a single frame
+	StreamChunkSize = 64 << 10
+	// MaxStreamFrameSize is the largest frame ciphertext accepted
+	MaxStreamFrameSize = 1 << 20
+
+	streamMagic       = "L8S1"
+	streamSaltSize    = 32
+	streamHeaderSize  = len(streamMagic) + streamSaltSize
+	streamFinalFlag   = 1 << 31
+	streamFrameHeader = 4
+	streamKeyInfo     = "layer8 stream"
+)
+
+// newStreamAEAD returns the AES-GCM cipher of the stream with the salt,
+// keyed with the key derived from the session key
+func newStreamAEAD(key *utils.JWK, salt []byte) (cipher.AEAD, error) {
+	secret, err := base64.URLEncoding.DecodeString(key.X)
+	if err != nil {
+		return nil, errors.New("unable to decode the session key: " + err.Error())
+	}
+	streamKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(streamKeyInfo)), streamKey); err != nil {
+		return nil, errors.New("unable to derive the stream key: " + err.Error())
+	}
+	block, err := aes.NewCipher(streamKey)
+	if err != nil {
+		return nil, errors.New("unable to create the stream cipher: " + err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+// streamNonce returns the nonce and the additional data of a frame
+func streamNonce(counter uint64, final bool) (nonce, ad []byte) {
+	nonce = make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+
+	ad = make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, counter)
+	if final {
+		ad[8] = 1
+	}
+	return nonce, ad
+}
+
+// StreamEncrypter seals a stream frame by frame
+type StreamEncrypter struct {
+	aead    cipher.AEAD
+	salt    []byte
+	counter uint64
+	started bool
+	closed  bool
+}
+
+// NewStreamEncrypter returns an encrypter for a new stream, with a random
+// salt. Its errors are ErrInternal errors.
+func NewStreamEncrypter(key *utils.JWK) (*StreamEncrypter, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, ErrInternal.Wrap(errors.New("unable to generate the stream salt: " + err.Error()))
+	}
+	aead, err := newStreamAEAD(key, salt)
+	if err != nil {
+		return nil, ErrInternal.Wrap(err)
+	}
+	return &StreamEncrypter{aead: aead, salt: salt}, nil
+}
+
+// Seal encrypts p in frames of at most StreamChunkSize bytes, preceded by the
+// stream header on the first call. When final is set, the last frame closes
+// the stream; an empty p then gives an empty final frame.
+func (e *StreamEncrypter) Seal(p []byte, final bool) ([]byte, error) {
+	if e.closed {
+		return nil, ErrInternal.Wrap(errors.New("stream is closed"))
+	}
+
+	var out bytes.Buffer
+	if !e.started {
+		e.started = true
+		out.WriteString(streamMagic)
+		out.Write(e.salt)
+	}
+
+	for len(p) > 0 || final {
+		n := len(p)
+		if n > StreamChunkSize {
+			n = StreamChunkSize
+		}
+		last := final && n == len(p)
+
+		nonce, ad := streamNonce(e.counter, last)
+		ciphertext := e.aead.Seal(nil, nonce, p[:n], ad)
+		e.counter++
+
+		header := uint32(len(ciphertext))
+		if last {
+			header |= streamFinalFlag
+		}
+		out.Write(binary.BigEndian.AppendUint32(nil, header))
+		out.Write(ciphertext)
+
+		p = p[n:]
+		if last {
+			e.closed = true
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// StreamDecrypter opens a stream as its bytes arrive
+type StreamDecrypter struct {
+	key     *utils.JWK
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+	// off is the number of bytes of buf already consumed
+	off  int
+	done bool
+}
+
+// NewStreamDecrypter returns a decrypter for a stream sealed with key
+func NewStreamDecrypter(key *utils.JWK) (*StreamDecrypter, error) {
+	if _, err := base64.URLEncoding.DecodeString(key.X); err != nil {
+		return nil, errors.New("unable to decode the session key: " + err.Error())
+	}
+	return &StreamDecrypter{key: key}, nil
+}
+
+// Write consumes the next bytes of the stream. It returns the plaintext of
+// the frames they complete, an ErrBadEnvelope for malformed streams and an
+// ErrDecryption for frames that fail to open.
+func (d *StreamDecrypter) Write(p []byte) ([][]byte, error) {
+	if d.done {
+		if len(p) > 0 {
+			return nil, ErrBadEnvelope.WithMessage("Data after the final frame of the stream")
+		}
+		return nil, nil
+	}
+
+	// the consumed bytes are dropped once they are most of the buffer, rather
+	// than copying the pending bytes on every call
+	if d.off > len(d.buf)/2 {
+		d.buf = d.buf[:copy(d.buf, d.buf[d.off:])]
+		d.off = 0
+	}
+	d.buf = append(d.buf, p...)
+
+	if d.aead == nil {
+		if len(d.buf) < streamHeaderSize {
+			return nil, nil
+		}
+		if string(d.buf[:len(streamMagic)]) != streamMagic {
+			return nil, ErrBadEnvelope.WithMessage("Request body is not an encrypted stream")
+		}
+		aead, err := newStreamAEAD(d.key, d.buf[len(streamMagic):streamHeaderSize])
+		if err != nil {
+			return nil, ErrInternal.Wrap(err)
+		}
+		d.aead = aead
+		d.off = streamHeaderSize
+	}
+
+	var frames [][]byte
+	for !d.done && len(d.buf)-d.off >= streamFrameHeader {
+		pending := d.buf[d.off:]
+		header := binary.BigEndian.Uint32(pending)
+		final := header&streamFinalFlag != 0
+		size := int(header &^ streamFinalFlag)
+		if size > MaxStreamFrameSize {
+			return nil, ErrBadEnvelope.WithMessage("Stream frame is too large")
+		}
+		if len(pending) < streamFrameHeader+size {
+			break
+		}
+
+		nonce, ad := streamNonce(d.counter, final)
+		frame, err := d.aead.Open(nil, nonce, pending[streamFrameHeader:streamFrameHeader+size], ad)
+		if err != nil {
+			return nil, ErrDecryption.Wrap(err)
+		}
+		d.counter++
+		d.off += streamFrameHeader + size
+		d.done = final
+		frames = append(frames, frame)
+	}
+
+	if d.done && len(d.buf) > d.off {
+		return nil, ErrBadEnvelope.WithMessage("Data after the final frame of the stream")
+	}
+	return frames, nil
+}
+
+// Close returns an ErrBadEnvelope when the stream ended before its final frame
+func (d *StreamDecrypter) Close() error {
+	if !d.done {
+		return ErrBadEnvelope.WithMessage("Stream ended before its final frame")
+	}
+	return nil
+}
+
+// streamRequest is the metadata frame of a streamed request
+type streamRequest struct {
+	utils.Request
+	URLPath string `json:"__url_path"`
+}
+
+// RequestStream decrypts a streamed request, see StreamDecrypter. The first
+// frame is the request as JSON, with its __url_path and without body, and
+// the other frames are its body, handed over as they are decrypted. The body
+// is bounded by the limits of the __url_path, see ProcessOptions.
+type RequestStream struct {
+	dec     *StreamDecrypter
+	options *ProcessOptions
+
+	request  *streamRequest
+	limits   Limits
+	bodySize int
+	err      error
+}
+
+// NewRequestStream returns a RequestStream decrypting with the session key.
+// The replay protection of the options applies to the metadata frame.
+func NewRequestStream(key *utils.JWK, options *ProcessOptions) (*RequestStream, error) {
+	dec, err := NewStreamDecrypter(key)
+	if err != nil {
+		return nil, ErrInternal.Wrap(err)
+	}
+	return &RequestStream{dec: dec, options: options}, nil
+}
+
+// Write consumes the next bytes of the request and returns the body frames
+// they complete. The request is available from Request once its metadata
+// frame was written. After an error, the following bytes are ignored and
+// Close returns the error.
+func (r *RequestStream) Write(p []byte) ([][]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	frames, err := r.dec.Write(p)
+	if err != nil {
+		r.err = err
+		return nil, err
+	}
+	if r.request == nil && len(frames) > 0 {
+		if err := r.readMetadata(frames[0]); err != nil {
+			r.err = err
+			return nil, err
+		}
+		frames = frames[1:]
+	}
+
+	for _, frame := range frames {
+		r.bodySize += len(frame)
+		if err := r.limits.Check(0, r.bodySize); err != nil {
+			r.err = err
+			return nil, err
+		}
+	}
+	return frames, nil
+}
+
+// readMetadata decodes the metadata frame and checks it against the replay
+// protection of the options
+func (r *RequestStream) readMetadata(frame []byte) error {
+	request := new(streamRequest)
+	if err := json.Unmarshal(frame, request); err != nil {
+		return ErrInvalidRequest.WithMessage("Could not decode request").Wrap(err)
+	}
+	if request.Method == "" {
+		return ErrInvalidRequest.WithMessage("Request is missing its method")
+	}
+	if request.Headers == nil {
+		request.Headers = make(map[string]string)
+	}
+	if r.options != nil && r.options.Replay != nil {
+		if err := checkReplay(frame, r.options); err != nil {
+			return err
+		}
+	}
+	if r.options != nil && r.options.Limits != nil {
+		r.limits = r.options.Limits.For(request.URLPath)
+	}
+	r.request = request
+	return nil
+}
+
+// Request returns the decrypted request, without its body, and its URL path,
+// nil until the metadata frame was written
+func (r *RequestStream) Request() (*utils.Request, string) {
+	if r.request == nil {
+		return nil, ""
+	}
+	request := r.request.Request
+	return &request, r.request.URLPath
+}
+
+// Close returns the error of the stream, or an ErrBadEnvelope when it ended
+// before its final frame
+func (r *RequestStream) Close() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.dec.Close()
+}
+
+// PrepareStreamMetadata returns the metadata frame of a streamed response:
+// the status and the headers of the response object, see PrepareData. The
+// content-type of binary bodies is detected from their first bytes, sniff,
+// when it is not set.
+func PrepareStreamMetadata(res *js.Value, sniff []byte) ([]byte, error) {
+	jres := NewResponse(res)
+	if sniff != nil && !hasHeader(jres.Headers, "content-type") {
+		jres.Headers["content-type"] = http.DetectContentType(sniff)
+	}
+
+	b, err := json.Marshal(jres)
+	if err != nil {
+		return nil, ErrInternal.Wrap(errors.New("error serializing json response: " + err.Error()))
+	}
+	return b, nil
+}
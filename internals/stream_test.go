@@ -0,0 +1,272 @@
+package internals
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"globe-and-citizen/layer8/middleware/js"
+	"globe-and-citizen/layer8/middleware/storage"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func streamKey(t *testing.T) *utils.JWK {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	shared, err := pri.GetECDHSharedSecret(pub)
+	assert.Nil(t, err)
+	return shared
+}
+
+// sealStream seals the chunks as a whole stream
+func sealStream(t *testing.T, key *utils.JWK, chunks ...[]byte) []byte {
+	enc, err := NewStreamEncrypter(key)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	for i, chunk := range chunks {
+		b, err := enc.Seal(chunk, i == len(chunks)-1)
+		assert.Nil(t, err)
+		out.Write(b)
+	}
+	return out.Bytes()
+}
+
+// openStream writes the stream to a decrypter n bytes at a time
+func openStream(key *utils.JWK, stream []byte, n int) ([]byte, error) {
+	dec, err := NewStreamDecrypter(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	for len(stream) > 0 {
+		size := n
+		if size > len(stream) {
+			size = len(stream)
+		}
+		frames, err := dec.Write(stream[:size])
+		if err != nil {
+			return nil, err
+		}
+		for _, frame := range frames {
+			out.Write(frame)
+		}
+		stream = stream[size:]
+	}
+	return out.Bytes(), dec.Close()
+}
+
+// streamFrames splits a stream into its header and its frames
+func streamFrames(stream []byte) ([]byte, [][]byte) {
+	header, stream := stream[:streamHeaderSize], stream[streamHeaderSize:]
+	frames := [][]byte{}
+	for len(stream) > 0 {
+		size := streamFrameHeader + int(binary.BigEndian.Uint32(stream)&^streamFinalFlag)
+		frames = append(frames, stream[:size])
+		stream = stream[size:]
+	}
+	return header, frames
+}
+
+func TestStream(t *testing.T) {
+	key := streamKey(t)
+	large := bytes.Repeat([]byte("0123456789abcdef"), StreamChunkSize/8+3)
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   []byte
+	}{
+		{"empty_stream", [][]byte{nil}, nil},
+		{"single_chunk", [][]byte{[]byte("hello")}, []byte("hello")},
+		{"several_chunks", [][]byte{[]byte("hello"), []byte(" "), []byte("world")}, []byte("hello world")},
+		{"empty_final_chunk", [][]byte{[]byte("hello"), nil}, []byte("hello")},
+		{"chunk_larger_than_a_frame", [][]byte{large}, large},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := sealStream(t, key, tt.chunks...)
+			for _, n := range []int{1, 7, len(stream)} {
+				got, err := openStream(key, stream, n)
+				assert.Nil(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+
+	t.Run("frames_are_bounded", func(t *testing.T) {
+		_, frames := streamFrames(sealStream(t, key, large))
+		assert.Equal(t, 3, len(frames))
+		for _, frame := range frames {
+			assert.LessOrEqual(t, len(frame), streamFrameHeader+StreamChunkSize+16)
+		}
+	})
+
+	t.Run("sealing_after_the_final_frame", func(t *testing.T) {
+		enc, err := NewStreamEncrypter(key)
+		assert.Nil(t, err)
+		_, err = enc.Seal([]byte("hello"), true)
+		assert.Nil(t, err)
+		_, err = enc.Seal([]byte("world"), false)
+		assert.True(t, errors.Is(err, ErrInternal))
+	})
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	key := streamKey(t)
+	stream := sealStream(t, key, []byte("first"), []byte("second"), []byte("third"))
+	header, frames := streamFrames(stream)
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, parts...), nil)
+	}
+
+	flipped := append([]byte{}, stream...)
+	flipped[len(flipped)-1] ^= 1
+
+	// marking the second frame as final must not truncate the stream
+	final := append([]byte{}, frames[1]...)
+	final[0] |= 0x80
+
+	oversize := binary.BigEndian.AppendUint32(nil, MaxStreamFrameSize+1)
+	_, otherFrames := streamFrames(sealStream(t, key, []byte("first"), []byte("second"), []byte("third")))
+
+	tests := []struct {
+		name          string
+		stream        []byte
+		key           *utils.JWK
+		expectedError *Error
+	}{
+		{"wrong_key", stream, streamKey(t), ErrDecryption},
+		{"flipped_bit", flipped, key, ErrDecryption},
+		{"reordered_frames", join(frames[1], frames[0], frames[2]), key, ErrDecryption},
+		{"replayed_frame", join(frames[0], frames[0], frames[1], frames[2]), key, ErrDecryption},
+		{"dropped_frame", join(frames[0], frames[2]), key, ErrDecryption},
+		{"forged_final_flag", join(frames[0], final), key, ErrDecryption},
+		{"truncated_stream", join(frames[0], frames[1]), key, ErrBadEnvelope},
+		{"truncated_frame", stream[:len(stream)-1], key, ErrBadEnvelope},
+		{"data_after_final_frame", append(append([]byte{}, stream...), frames[0]...), key, ErrBadEnvelope},
+		{"oversize_frame", join(oversize), key, ErrBadEnvelope},
+		{"not_a_stream", []byte(`{"data":"..."}`), key, ErrBadEnvelope},
+		// every stream has a key of its own, derived from its salt
+		{"frames_of_another_stream", join(otherFrames...), key, ErrDecryption},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := openStream(tt.key, tt.stream, len(tt.stream))
+			assert.True(t, errors.Is(err, tt.expectedError), "got %v", err)
+		})
+	}
+}
+
+func TestRequestStream(t *testing.T) {
+	key := streamKey(t)
+	now := time.Now()
+
+	metadata := func(seq uint64) []byte {
+		b, err := json.Marshal(map[string]interface{}{
+			"method":     "POST",
+			"headers":    map[string]string{"content-type": "application/octet-stream"},
+			"__url_path": "/upload?name=a",
+			"seq":        seq,
+			"ts":         now.UnixMilli(),
+		})
+		assert.Nil(t, err)
+		return b
+	}
+
+	options := &ProcessOptions{
+		Replay: new(storage.ReplayWindow),
+		now:    func() time.Time { return now },
+	}
+
+	tests := []struct {
+		name          string
+		stream        []byte
+		expectedError *Error // nil when the request is accepted
+	}{
+		{"request", sealStream(t, key, metadata(1), []byte("part 1, "), []byte("part 2")), nil},
+		{"replayed_request", sealStream(t, key, metadata(1), []byte("part 1, "), []byte("part 2")), ErrReplay},
+		{"missing_method", sealStream(t, key, []byte(`{"seq":2}`), nil), ErrInvalidRequest},
+		{"invalid_metadata", sealStream(t, key, []byte("not json"), nil), ErrInvalidRequest},
+		{"truncated_request", sealStream(t, key, metadata(3), []byte("part 1, "), nil)[:60], ErrBadEnvelope},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := NewRequestStream(key, options)
+			assert.Nil(t, err)
+
+			// the body frames are handed over as they are decrypted
+			var body [][]byte
+			for _, b := range tt.stream {
+				frames, err := stream.Write([]byte{b})
+				if err != nil {
+					break
+				}
+				body = append(body, frames...)
+			}
+
+			err = stream.Close()
+			if tt.expectedError != nil {
+				assert.True(t, errors.Is(err, tt.expectedError), "got %v", err)
+				return
+			}
+			assert.Nil(t, err)
+			request, urlPath := stream.Request()
+			assert.Equal(t, "POST", request.Method)
+			assert.Equal(t, "application/octet-stream", request.Headers["content-type"])
+			assert.Equal(t, [][]byte{[]byte("part 1, "), []byte("part 2")}, body)
+			assert.Equal(t, "/upload?name=a", urlPath)
+		})
+	}
+
+	// the request is available before its body
+	stream, err := NewRequestStream(key, nil)
+	assert.Nil(t, err)
+	whole := sealStream(t, key, metadata(4), []byte("part 1, "), []byte("part 2"))
+	_, frames := streamFrames(whole)
+	body, err := stream.Write(whole[:streamHeaderSize+len(frames[0])])
+	assert.Nil(t, err)
+	assert.Empty(t, body)
+	request, _ := stream.Request()
+	assert.Equal(t, "POST", request.Method)
+	assert.True(t, errors.Is(stream.Close(), ErrBadEnvelope))
+
+	// the body is bounded by the limits of its route
+	stream, err = NewRequestStream(key, &ProcessOptions{
+		Limits: &RouteLimits{Routes: map[string]Limits{"/upload": {MaxBodySize: 10}}},
+	})
+	assert.Nil(t, err)
+	_, err = stream.Write(sealStream(t, key, metadata(5), []byte("part 1, "), []byte("part 2")))
+	assert.True(t, errors.Is(err, ErrTooLarge))
+	assert.True(t, errors.Is(stream.Close(), ErrTooLarge))
+}
+
+func TestPrepareStreamMetadata(t *testing.T) {
+	res := js.ValueOf(map[string]interface{}{
+		"statusCode": float64(201),
+		"statusText": "Created",
+		"headers": map[string]interface{}{
+			"x-key": "value",
+		},
+	})
+
+	b, err := PrepareStreamMetadata(res, []byte("\x89PNG\r\n\x1a\n"))
+	assert.Nil(t, err)
+
+	var response Response
+	assert.Nil(t, json.Unmarshal(b, &response))
+	assert.Equal(t, 201, response.Status)
+	assert.Equal(t, "Created", response.StatusText)
+	assert.Equal(t, "value", response.Headers["x-key"])
+	assert.Equal(t, "image/png", response.Headers["content-type"])
+	assert.Nil(t, response.Body)
+}
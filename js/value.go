@@ -17,6 +17,8 @@ const (
 	TypeObject
 	TypeArray
 	TypeNull
+	// TypeBinary holds the bytes of a Buffer, a TypedArray or an ArrayBuffer
+	TypeBinary
 )
 
 func ValueOf(value interface{}) *Value {
@@ -27,6 +29,9 @@ func ValueOf(value interface{}) *Value {
 	}
 
 	switch val := value.(type) {
+	case nil:
+		result.Type = TypeNull
+		result.Constructor = "Null"
 	case int, int32, int64, uint, uint32, uint64, float32, float64:
 		result.Type = TypeNumber
 		result.Constructor = "Number"
@@ -39,6 +44,10 @@ func ValueOf(value interface{}) *Value {
 		result.Type = TypeString
 		result.Constructor = "String"
 		result.Value = val
+	case []byte:
+		result.Type = TypeBinary
+		result.Constructor = "Uint8Array"
+		result.Value = val
 	case map[string]interface{}:
 		obj := make(map[string]*Value, len(val))
 		for k, v := range val {
@@ -64,7 +73,7 @@ func ValueOf(value interface{}) *Value {
 func (v *Value) GetValue() interface{} {
 	switch v.Type {
 	case TypeNumber:
-		return v.Value.(float64)
+		return v.Number()
 	case TypeBoolean:
 		return v.Value.(bool)
 	case TypeString:
@@ -85,6 +94,8 @@ func (v *Value) GetValue() interface{} {
 			result[i] = v.GetValue()
 		}
 		return result
+	case TypeBinary:
+		return v.Value.([]byte)
 	default:
 		return nil
 	}
@@ -175,6 +186,13 @@ func (v *Value) Bool() bool {
 	return false
 }
 
+func (v *Value) Bytes() []byte {
+	if v.Type == TypeBinary {
+		return v.Value.([]byte)
+	}
+	return nil
+}
+
 func (v *Value) Number() float64 {
 	switch v.Value.(type) {
 	case int:
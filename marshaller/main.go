@@ -14,7 +14,17 @@ import (
 //   - String
 //   - Object (recursively converted to map[string]interface{})
 //   - Array (recursively converted to []interface{})
+//
+// A Buffer, a TypedArray or an ArrayBuffer is unmarshaled as binary data.
 func Unmarshal(v js.Value) *gojs.Value {
+	if b, ok := Bytes(v); ok {
+		return &gojs.Value{
+			Type:        gojs.TypeBinary,
+			Constructor: v.Get("constructor").Get("name").String(),
+			Value:       b,
+		}
+	}
+
 	keys := js.Global().Get("Object").Call("keys", v)
 	m := &gojs.Value{
 		Type:        gojs.TypeObject,
@@ -112,3 +122,27 @@ func parseObjectToSlice(obj js.Value) []*gojs.Value {
 
 	return s
 }
+
+// Bytes copies the bytes of a Buffer, a TypedArray, a DataView or an
+// ArrayBuffer. It returns false for other values.
+func Bytes(v js.Value) ([]byte, bool) {
+	if v.Type() != js.TypeObject {
+		return nil, false
+	}
+
+	var view js.Value
+	switch uint8Array := js.Global().Get("Uint8Array"); {
+	case v.InstanceOf(uint8Array):
+		view = v
+	case js.Global().Get("ArrayBuffer").Call("isView", v).Bool():
+		view = uint8Array.New(v.Get("buffer"), v.Get("byteOffset"), v.Get("byteLength"))
+	case v.InstanceOf(js.Global().Get("ArrayBuffer")):
+		view = uint8Array.New(v)
+	default:
+		return nil, false
+	}
+
+	b := make([]byte, view.Get("length").Int())
+	js.CopyBytesToGo(b, view)
+	return b, true
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
-	"net/url"
 	"strings"
+	"sync"
 	"syscall/js"
+	"time"
 
 	"globe-and-citizen/layer8/middleware/internals"
-	gojs "globe-and-citizen/layer8/middleware/js"
 	"globe-and-citizen/layer8/middleware/marshaller"
 	"globe-and-citizen/layer8/middleware/storage"
 
@@ -21,11 +24,10 @@ import (
 const VERSION = "1.0.26"
 
 func init() {
-	var err error
-	// generate key pair
+	// generate a key pair, it can be replaced with LoadServerKey before the first request
 	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
 	if err != nil {
-		panic(err)
+		println("error generating server key pair, load one with LoadServerKey:", err.Error())
 	}
 
 	storage.InitInMemStorage(pri, pub)
@@ -38,6 +40,9 @@ func main() {
 	js.Global().Set("ServeStatic", js.FuncOf(static))
 	js.Global().Set("ProcessMultipart", js.FuncOf(multipart))
 	js.Global().Set("TestWASM", js.FuncOf(TestWASM))
+	js.Global().Set("ConfigureMiddleware", js.FuncOf(configure))
+	js.Global().Set("LoadServerKey", js.FuncOf(LoadServerKey))
+	js.Global().Set("RotateServerKey", js.FuncOf(RotateServerKey))
 	<-c
 }
 
@@ -52,6 +57,7 @@ func WASMMiddleware_v2(this js.Value, args []js.Value) interface{} {
 		goHeaders = marshaller.Unmarshal(headers)
 		db        = storage.GetInMemStorage()
 	)
+	defer recoverRequest(res)
 
 	// proceed to next middleware/handler request is not a layer8 request
 	if headers.String() == "<undefined>" || headers.Get("x-tunnel").String() == "<undefined>" {
@@ -60,20 +66,22 @@ func WASMMiddleware_v2(this js.Value, args []js.Value) interface{} {
 	}
 
 	initECDH := func() interface{} {
-		secret, pub, mpjwt, err := internals.InitializeECDH(goHeaders)
+		handshake, err := internals.InitializeECDH(goHeaders, settings.jwtVerifier)
 		if err != nil {
-			println(err.Error())
-			res.Set("statusCode", 500)
-			res.Set("statusMessage", "Failure to initialize ECDH")
-			res.Call("end", "500 Internal Server Error")
+			sendError(res, err)
 			return nil
 		}
 
 		res.Set("statusCode", 200)
 		res.Set("statusMessage", "ECDH Successfully Completed!")
-		res.Call("setHeader", "x-shared-secret", secret)
-		res.Call("setHeader", "mp-JWT", mpjwt)
-		res.Call("end", pub)
+		// the shared secret is only echoed for clients that cannot derive it themselves
+		if settings.exposeSharedSecret {
+			res.Call("setHeader", "x-shared-secret", handshake.SharedSecret)
+		}
+		res.Call("setHeader", "x-key-confirmation", handshake.KeyConfirmation)
+		res.Call("setHeader", "x-server-key-id", handshake.KeyID)
+		res.Call("setHeader", "mp-JWT", handshake.MpJWT)
+		res.Call("end", handshake.PublicKey)
 		return nil
 	}
 
@@ -90,41 +98,43 @@ func WASMMiddleware_v2(this js.Value, args []js.Value) interface{} {
 		return nil
 	}
 
-	// Get the symmetric key for this client
-	var spSymmetricKey *utils.JWK
-	for _, v := range db.Keys {
-		if v[clientUUID] != nil {
-			spSymmetricKey = v[clientUUID]
-		}
+	// Get the session (symmetric key and JWT) for this client
+	// an unknown session is not renegotiated here, the data request would
+	// not be a valid handshake: the interceptor is told to redo it instead
+	session, err := db.GetSession(clientUUID)
+	if err != nil {
+		sendError(res, sessionError(err))
+		return nil
 	}
-	if spSymmetricKey == nil {
-		return initECDH()
+	if err := db.Sessions.Touch(clientUUID); err != nil {
+		println("error touching session:", err.Error())
 	}
 
-	// Get the JWT for this client
-	var MpJWT string
-	for _, v := range db.JWTs {
-		if v[clientUUID] != "" {
-			MpJWT = v[clientUUID]
-		}
-	}
-	if MpJWT == "" {
-		return initECDH()
+	var (
+		spSymmetricKey = session.Key
+		MpJWT          = session.JWT
+	)
+
+	// streamed requests are decrypted frame by frame as they arrive
+	if headers.Get(internals.StreamHeader).Truthy() {
+		streamRequest(req, res, next, optionalArg(args, 3), clientUUID, session)
+		return nil
 	}
 
-	var body string
+	// the raw bytes of the body, decoded once it is complete: a multi-byte
+	// character can be split across chunks
+	var body bytes.Buffer
 
-	req.Call("on", "data", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		body += args[0].Call("toString").String()
-		return nil
-	}))
+	req.Call("on", "data", collectBody(req, res, &body))
 
 	req.Call("on", "end", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
 		// Occur under all circumstances:
-		response, request := internals.ProcessData(body, spSymmetricKey)
-		if response != nil {
-			res.Set("statusCode", response.Status)
-			res.Set("statusMessage", response.StatusText)
+		envelopeSize := body.Len()
+		request, err := internals.ProcessData(body.String(), spSymmetricKey, processOptions(clientUUID))
+		if err != nil {
+			sendError(res, err)
 			return nil
 		}
 
@@ -133,6 +143,9 @@ func WASMMiddleware_v2(this js.Value, args []js.Value) interface{} {
 			headers.Set(k, v)
 		}
 
+		// the path of the request, before it is rewritten for the handlers
+		var urlPath string
+
 		// Primary Decisiotn Point
 		switch strings.ToLower(request.Headers["Content-Type"]) {
 		case "application/layer8.buffer+json": // this is used for multipart/form-data
@@ -141,27 +154,33 @@ func WASMMiddleware_v2(this js.Value, args []js.Value) interface{} {
 
 			json.Unmarshal(request.Body, &reqBody)
 
-			// clear the body as it will be replaced by the formdata
+			// clear the body as it will be replaced by the formdata, its
+			// decrypted size is checked against the limits first
+			bodySize := len(request.Body)
 			request.Body = nil
 
 			// get the url path
-			urlPath := getUrlPathFromBody(reqBody)
+			urlPath = getUrlPathFromBody(reqBody)
 
 			req.Set("url", urlPath)
 
+			limits := settings.limits.For(urlPath)
+			if err := limits.Check(envelopeSize, bodySize); err != nil {
+				sendError(res, err)
+				return nil
+			}
+
 			// pass in reqBody and get out a formData
-			formdata, err := convertBodyToFormdata(reqBody)
+			formdata, err := convertBodyToFormdata(reqBody, limits)
 			if err != nil {
-				fmt.Println("error decoding file buffer:", err.Error())
-				res.Set("statusCode", 500)
-				res.Set("statusMessage", "Could not decode file buffer: "+err.Error())
+				sendError(res, err)
+				return nil
 			}
 
 			boundary, err := getArbitraryBoundary()
 			if err != nil {
-				fmt.Println("error generating random bytes:", err.Error())
-				res.Set("statusCode", 500)
-				res.Set("statusMessage", "Could not generate random bytes: "+err.Error())
+				sendError(res, internals.ErrInternal.Wrap(err))
+				return nil
 			}
 
 			request.Headers["Content-Type"] = "multipart/form-data; boundary=" + boundary
@@ -175,70 +194,276 @@ func WASMMiddleware_v2(this js.Value, args []js.Value) interface{} {
 			var body map[string]interface{}
 			json.Unmarshal(request.Body, &body)
 
-			if body["__url_path"] != nil {
-				path, queryParams := utils.ParseURLPath(body["__url_path"].(string))
-				req.Set("url", path)
-				if queryParams != "" {
-					queryParamsMap := utils.ParseQueryParams(queryParams)
-					for k, v := range queryParamsMap {
-						req.Get("query").Set(k, v)
-					}
-				}
+			if p, ok := body["__url_path"].(string); ok {
+				urlPath = p
+				setURL(req, urlPath)
 				// Remove [__url_path] from body
 				delete(body, "__url_path")
 			}
 
+			if err := settings.limits.For(urlPath).Check(envelopeSize, len(request.Body)); err != nil {
+				sendError(res, err)
+				return nil
+			}
+
 			req.Set("body", body)
 		}
 
+		// encrypt everything the handlers write to the response
+		wrapResponse(res, request, urlPath, spSymmetricKey, MpJWT, nil)
+
 		// continue to next middleware/handler
 		next.Invoke()
 		return nil
 	}))
 
-	// OVERWRITE ALL RESPONSE FUNCTIONS
-	respond := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		// we'll need to convert some of the args to a map
-		// this is for instances where the user wants to send a json response
-		// and the args are stringified json
-		data := new(gojs.Value)
-		if args[0].Type() == js.TypeString {
-			var (
-				mapData map[string]interface{}
-				err     = json.Unmarshal([]byte(args[0].String()), &mapData)
-			)
-			if err != nil {
-				// when JSON data cannot be unmarshalled, we'll just send the string as is
-				// this is useful for sending plain text responses
-				data = gojs.ValueOf(args[0].String())
+	return nil
+}
+
+// streamRequest handles a request whose body is an encrypted stream, see
+// internals.StreamHeader. The frames are decrypted as the chunks arrive. A
+// JSON body is collected and parsed before the request reaches the handlers,
+// as for the other requests. Any other body is piped to req.body, a Readable
+// created with the readable constructor, and the request reaches the handlers
+// as soon as its metadata frame is decrypted. The response is streamed back.
+func streamRequest(req, res, next, readable js.Value, clientUUID string, session *storage.Session) {
+	headers := req.Get("headers")
+
+	stream, err := internals.NewRequestStream(session.Key, processOptions(clientUUID))
+	if err != nil {
+		sendError(res, err)
+		return
+	}
+
+	var (
+		request *utils.Request
+		urlPath string
+		// t is set once the request reached the handlers
+		t *tunnelResponse
+		// body is the Readable of a piped body, jsonBody the collected JSON body
+		body     js.Value
+		jsonBody *bytes.Buffer
+	)
+
+	// handle passes the request to the handlers, encrypting the response
+	handle := func() {
+		enc, err := internals.NewStreamEncrypter(session.Key)
+		if err != nil {
+			rejectRequest(req, res, err)
+			return
+		}
+		t = wrapResponse(res, request, urlPath, session.Key, session.JWT, enc)
+		next.Invoke()
+	}
+
+	// fail rejects the request before it reached the handlers. Once they
+	// read the body, it is destroyed, with the error when they listen for
+	// it, and the response fails unless it was already sent.
+	fail := func(err error) {
+		if t == nil {
+			rejectRequest(req, res, err)
+			return
+		}
+		req.Call("removeAllListeners", "data")
+		req.Call("removeAllListeners", "end")
+		req.Call("resume")
+		if body.Truthy() && !body.Get("destroyed").Bool() {
+			if body.Call("listenerCount", "error").Int() > 0 {
+				body.Call("destroy", js.Global().Get("Error").New(err.Error()))
 			} else {
-				data = gojs.ValueOf(mapData)
+				body.Call("destroy")
 			}
+		}
+		if !t.sent {
+			t.fail(err)
+		}
+	}
+
+	// dispatch sets up the request once its metadata frame is decrypted
+	dispatch := func() {
+		req.Set("method", request.Method)
+		for k, v := range request.Headers {
+			headers.Set(k, v)
+		}
+		if urlPath != "" {
+			setURL(req, urlPath)
+		}
+
+		if isJSON(request.Headers) {
+			jsonBody = new(bytes.Buffer)
+			return
+		}
+		if readable.Type() != js.TypeFunction {
+			rejectRequest(req, res, internals.ErrInternal.Wrap(errors.New("a Readable constructor is required to stream request bodies")))
+			return
+		}
+
+		// the request is paused while the handlers do not read the body
+		read := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			req.Call("resume")
+			return nil
+		})
+		body = readable.New(map[string]interface{}{"read": read})
+		var release js.Func
+		release = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			read.Release()
+			release.Release()
+			return nil
+		})
+		body.Call("once", "close", release)
+
+		req.Set("body", body)
+		handle()
+	}
+
+	req.Call("on", "data", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		b, _ := chunkBytes(args[0], js.Undefined())
+		frames, err := stream.Write(b)
+		if err != nil {
+			fail(err)
+			return nil
+		}
+		if request == nil {
+			if request, urlPath = stream.Request(); request != nil {
+				dispatch()
+			}
+		}
+
+		for _, frame := range frames {
+			switch {
+			case jsonBody != nil:
+				jsonBody.Write(frame)
+			case body.Truthy() && !body.Get("destroyed").Bool():
+				if !body.Call("push", bytesToJS(frame)).Bool() {
+					req.Call("pause")
+				}
+			}
+		}
+		return nil
+	}))
+
+	req.Call("on", "end", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		if err := stream.Close(); err != nil {
+			fail(err)
+			return nil
+		}
+
+		if jsonBody == nil {
+			if body.Truthy() {
+				body.Call("push", js.Null())
+			}
+			return nil
+		}
+
+		var parsed map[string]interface{}
+		if json.Unmarshal(jsonBody.Bytes(), &parsed) == nil {
+			req.Set("body", parsed)
 		} else {
-			data = marshaller.Unmarshal(args[0])
+			buffer := js.Global().Get("Buffer").Call("alloc", jsonBody.Len())
+			js.CopyBytesToJS(buffer, jsonBody.Bytes())
+			req.Set("body", buffer)
 		}
+		handle()
+		return nil
+	}))
+}
+
+// isJSON reports whether the content-type of the request is JSON
+func isJSON(headers map[string]string) bool {
+	for k, v := range headers {
+		if strings.EqualFold(k, "content-type") {
+			mediaType, _, _ := mime.ParseMediaType(v)
+			return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+		}
+	}
+	return false
+}
 
-		response := internals.PrepareData(marshaller.Unmarshal(res), data, spSymmetricKey, MpJWT)
-		res.Set("statusCode", response.Status)
-		res.Set("statusMessage", response.StatusText)
-		res.Call("set", js.ValueOf(MapOfStringsToMapOfInterfaces(response.Headers)))
-		res.Call("end", js.Global().Get("JSON").Call("stringify", js.ValueOf(map[string]interface{}{
-			"data": base64.URLEncoding.EncodeToString(response.Body),
-		})))
+// collectBody returns the data listener buffering the raw bytes of the
+// request body in body. Past the largest envelope size of the limits, the
+// request is rejected, see rejectRequest.
+func collectBody(req, res js.Value, body *bytes.Buffer) js.Func {
+	maxSize := settings.limits.MaxEnvelopeSize()
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		b, _ := chunkBytes(args[0], js.Undefined())
+		if body.Len()+len(b) > maxSize {
+			rejectRequest(req, res, internals.ErrTooLarge.WithMessage(fmt.Sprintf("Request body exceeds %d bytes", maxSize)))
+			return nil
+		}
+		body.Write(b)
 		return nil
 	})
+}
 
-	res.Set("send", respond)
-	res.Set("json", respond)
-	return nil
+// rejectRequest fails a request whose body is still being received: the
+// listeners of the body are removed, the rest of it is discarded, and the
+// response ends with err
+func rejectRequest(req, res js.Value, err error) {
+	req.Call("removeAllListeners", "data")
+	req.Call("removeAllListeners", "end")
+	req.Call("resume")
+	sendError(res, err)
+}
+
+// setURL rewrites the URL and the query of the request to the __url_path of
+// the decrypted request
+func setURL(req js.Value, urlPath string) {
+	path, queryParams := utils.ParseURLPath(urlPath)
+	req.Set("url", path)
+	if queryParams != "" {
+		queryParamsMap := utils.ParseQueryParams(queryParams)
+		for k, v := range queryParamsMap {
+			req.Get("query").Set(k, v)
+		}
+	}
+}
+
+// staticMount serves the files of a directory mounted with `static()`. Its
+// options are read and its file cache created once per mount.
+type staticMount struct {
+	dir     string
+	fs      js.Value
+	options staticOptions
+	// cache is nil unless the cache option is set
+	cache *storage.FileCache
+
+	rootOnce sync.Once
+	root     string
+	rootErr  error
 }
 
+// static returns the handler of a static mount, `(req, res) => void`
+//
+// Arguments:
+//   - dir: the directory of the files
+//   - fs: the Node fs module
+//   - options: see newStaticOptions
 func static(this js.Value, args []js.Value) interface{} {
+	options, err := newStaticOptions(optionalArg(args, 2))
+	if err != nil {
+		return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			sendError(args[1], internals.ErrInternal.Wrap(err))
+			return nil
+		})
+	}
+
+	m := &staticMount{dir: args[0].String(), fs: args[1], options: options}
+	if options.cache != nil {
+		m.cache = storage.NewFileCache(*options.cache)
+	}
+	return js.FuncOf(m.serve)
+}
+
+func (m *staticMount) serve(this js.Value, args []js.Value) interface{} {
 	var (
 		req     = args[0]
 		res     = args[1]
-		dir     = args[2].String()
-		fs      = args[3]
 		headers = req.Get("headers")
 		db      = storage.GetInMemStorage()
 
@@ -254,41 +479,39 @@ func static(this js.Value, args []js.Value) interface{} {
 			return nil
 		}
 	)
+	defer recoverRequest(res)
 
 	clientUUID := headers.Get("x-client-uuid").String()
 	if clientUUID == "<undefined>" {
 		return returnEncryptedImage()
 	}
 
-	var mpJWT string
-	for _, v := range db.JWTs {
-		if v[clientUUID] != "" {
-			mpJWT = v[clientUUID]
-		}
-	}
-
-	var sym *utils.JWK
-	for _, v := range db.Keys {
-		if v[clientUUID] != nil {
-			sym = v[clientUUID]
+	session, err := db.GetSession(clientUUID)
+	if err != nil {
+		// tunneled requests are told to redo the handshake
+		if headers.Get("x-tunnel").Truthy() {
+			sendError(res, sessionError(err))
+			return nil
 		}
-	}
-	if sym == nil {
 		return returnEncryptedImage()
 	}
+	if err := db.Sessions.Touch(clientUUID); err != nil {
+		println("error touching session:", err.Error())
+	}
 
-	var body string
+	// the raw bytes of the body, decoded once it is complete: a multi-byte
+	// character can be split across chunks
+	var body bytes.Buffer
 
-	req.Call("on", "data", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		body += args[0].Call("toString").String()
-		return nil
-	}))
+	req.Call("on", "data", collectBody(req, res, &body))
 	req.Call("on", "end", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
 		// Occur under all circumstances:
-		response, request := internals.ProcessData(body, sym)
-		if response != nil {
-			res.Set("statusCode", response.Status)
-			res.Set("statusMessage", response.StatusText)
+		envelopeSize := body.Len()
+		request, err := internals.ProcessData(body.String(), session.Key, processOptions(clientUUID))
+		if err != nil {
+			sendError(res, err)
 			return nil
 		}
 
@@ -303,100 +526,252 @@ func static(this js.Value, args []js.Value) interface{} {
 		var body map[string]interface{}
 		json.Unmarshal(request.Body, &body)
 
-		if body["__url_path"] != nil {
-			path, queryParams := utils.ParseURLPath(body["__url_path"].(string))
-			req.Set("url", path)
-			if queryParams != "" {
-				queryParamsMap := utils.ParseQueryParams(queryParams)
-				for k, v := range queryParamsMap {
-					req.Get("query").Set(k, v)
-				}
-			}
+		urlPath, _ := body["__url_path"].(string)
+		if urlPath != "" {
+			setURL(req, urlPath)
 
 			// Remove [__url_path] from body
 			delete(body, "__url_path")
 		}
+		if err := settings.limits.For(urlPath).Check(envelopeSize, len(request.Body)); err != nil {
+			sendError(res, err)
+			return nil
+		}
 
 		// req.Set("body", body)
 
-		// get the file path
-		path := req.Get("url").String()
-		if path == "/" {
-			path = "/index.html"
+		// find the file, the query of the __url_path is kept in redirects
+		if urlPath == "" {
+			urlPath = req.Get("url").String()
 		}
 
-		path, err := url.QueryUnescape(path)
-		if err != nil {
-			println("error url decoding path:", err.Error())
-			res.Set("statusCode", 500)
-			res.Set("statusMessage", "Internal Server Error")
-			res.Call("end", "500 Internal Server Error")
-			return nil
-		}
+		// the file system is accessed through fs.promises, whose results
+		// are awaited in a goroutine of its own
+		go func() {
+			defer recoverRequest(res)
 
-		path = dir + path
-		exists := fs.Call("existsSync", path).Bool()
-		if !exists {
-			res.Set("statusCode", 404)
-			res.Set("statusMessage", "Not Found")
-			res.Call("end", "Cannot GET "+req.Get("url").String())
-			return nil
-		}
+			fsys := &nodeFS{fs: m.fs, stats: make(map[string]js.Value)}
+			file, err := internals.FindStaticFile(fsys, m.dir, urlPath, m.options.StaticOptions)
+			if errors.Is(err, internals.ErrNotFound) {
+				sendError(res, internals.ErrNotFound.WithMessage("Cannot GET "+req.Get("url").String()))
+				return
+			}
+			if err != nil {
+				sendError(res, err)
+				return
+			}
 
-		// return the default EncryptedImageData if the request is not a layer8 request
-		if headers.String() == "<undefined>" || headers.Get("x-tunnel").String() == "<undefined>" {
-			return returnEncryptedImage()
-		}
+			// return the default EncryptedImageData if the request is not a layer8 request
+			if headers.String() == "<undefined>" || headers.Get("x-tunnel").String() == "<undefined>" {
+				returnEncryptedImage()
+				return
+			}
 
-		// read the file
-		buffer := fs.Call("readFileSync", path)
-		b := make([]byte, buffer.Get("length").Int())
-		js.CopyBytesToGo(b, buffer)
+			m.sendFile(res, fsys, file, request, session)
+		}()
+		return nil
+	}))
 
-		// create a response object
-		jres := utils.Response{
-			Body:       b,
-			Status:     http.StatusOK,
-			StatusText: http.StatusText(http.StatusOK),
+	return nil
+}
+
+// sendFile sends the file found for the request, or its redirect. It awaits
+// the fs promises and must run in a goroutine of its own.
+func (m *staticMount) sendFile(res js.Value, fsys *nodeFS, file *internals.StaticFile, request *utils.Request, session *storage.Session) {
+	if file.Redirect != "" {
+		sendStatic(res, session.Key, session.JWT, &utils.Response{
+			Body:       []byte(http.StatusText(http.StatusMovedPermanently) + ". Redirecting to " + file.Redirect),
+			Status:     http.StatusMovedPermanently,
+			StatusText: http.StatusText(http.StatusMovedPermanently),
 			Headers: map[string]string{
-				"content-type": http.DetectContentType(b),
+				"content-type": "text/plain; charset=utf-8",
+				"location":     file.Redirect,
 			},
+		})
+		return
+	}
+
+	// a symbolic link under the root must not lead out of it
+	root, err := m.realRoot()
+	if err != nil {
+		sendError(res, internals.ErrInternal.Wrap(errors.New("error resolving the static directory: "+err.Error())))
+		return
+	}
+	realPath, err := awaitPromise(m.fs.Get("promises").Call("realpath", file.Path))
+	if err != nil {
+		sendError(res, internals.ErrInternal.Wrap(errors.New("error resolving file: "+err.Error())))
+		return
+	}
+	if !internals.WithinRoot(root, realPath.String()) {
+		sendError(res, internals.ErrForbidden)
+		return
+	}
+
+	// the stat of the lookup validates the cached content
+	stat, err := fsys.stat(file.Path)
+	if err != nil {
+		sendError(res, internals.ErrInternal.Wrap(errors.New("error reading file: "+err.Error())))
+		return
+	}
+	modTime := time.UnixMilli(int64(stat.Get("mtimeMs").Float()))
+	size := int64(stat.Get("size").Float())
+
+	if m.cache != nil {
+		if cached, ok := m.cache.Get(file.Path, modTime, size); ok {
+			serveStaticFile(res, session.Key, session.JWT, request, file.Path, cached, modTime, m.options)
+			return
 		}
+	}
 
-		b, err = jres.ToJSON()
-		if err != nil {
-			println("error serializing json response:", err.Error())
-			res.Set("statusCode", 500)
-			res.Set("statusMessage", "Internal Server Error")
-			res.Call("end", "500 Internal Server Error")
-			return nil
+	buffer, err := awaitPromise(m.fs.Get("promises").Call("readFile", file.Path))
+	if err != nil {
+		if m.cache != nil {
+			m.cache.Invalidate(file.Path)
 		}
+		sendError(res, internals.ErrInternal.Wrap(errors.New("error reading file: "+err.Error())))
+		return
+	}
+	b := make([]byte, buffer.Get("length").Int())
+	js.CopyBytesToGo(b, buffer)
 
-		// encrypt the file
-		encrypted, err := sym.SymmetricEncrypt(b)
+	cached := &storage.CachedFile{Content: b, ETag: internals.ETag(b)}
+	if m.cache != nil {
+		m.cache.Put(file.Path, modTime, size, cached)
+	}
+	serveStaticFile(res, session.Key, session.JWT, request, file.Path, cached, modTime, m.options)
+}
+
+// realRoot returns the real path of the directory, resolved once
+func (m *staticMount) realRoot() (string, error) {
+	m.rootOnce.Do(func() {
+		root, err := awaitPromise(m.fs.Get("promises").Call("realpath", m.dir))
 		if err != nil {
-			println("error encrypting file:", err.Error())
-			res.Set("statusCode", 500)
-			res.Set("statusMessage", "Internal Server Error")
-			res.Call("end", "500 Internal Server Error")
-			return nil
+			m.rootErr = err
+			return
 		}
+		m.root = root.String()
+	})
+	return m.root, m.rootErr
+}
 
-		// send the response
-		res.Set("statusCode", jres.Status)
-		res.Set("statusMessage", jres.StatusText)
-		res.Call("set", js.ValueOf(map[string]interface{}{
-			"content-type": "application/json",
-			"mp-JWT":       mpJWT,
-		}))
-		res.Call("end", js.Global().Get("JSON").Call("stringify", js.ValueOf(map[string]interface{}{
-			"data": base64.URLEncoding.EncodeToString(encrypted),
-		})))
+// serveStaticFile sends the content of a static file, or a 304 when the
+// conditional headers of the decrypted request match it. The 304 is sent
+// inside the tunnel.
+func serveStaticFile(res js.Value, key *utils.JWK, jwt string, request *utils.Request, path string, file *storage.CachedFile, modTime time.Time, options staticOptions) {
+	lastModified := modTime.UTC().Format(http.TimeFormat)
+	if internals.NotModified(request.Method, request.Headers, file.ETag, modTime) {
+		sendStatic(res, key, jwt, &utils.Response{
+			Status:     http.StatusNotModified,
+			StatusText: http.StatusText(http.StatusNotModified),
+			Headers: map[string]string{
+				"etag":          file.ETag,
+				"last-modified": lastModified,
+			},
+		})
+		return
+	}
 
-		return nil
+	sendStatic(res, key, jwt, &utils.Response{
+		Body:       file.Content,
+		Status:     http.StatusOK,
+		StatusText: http.StatusText(http.StatusOK),
+		Headers: map[string]string{
+			"content-type":  internals.ContentType(path, file.Content, options.mimeTypes),
+			"etag":          file.ETag,
+			"last-modified": lastModified,
+		},
+	})
+}
+
+// sendStatic encrypts the response of a static file and ends res with it.
+// As for the responses of the handlers, see tunnelResponse, the status of a
+// redirect or of a 304 is only sent encrypted: the interceptor follows the
+// redirect through the tunnel, and a plaintext 304 would have no body to
+// carry the encrypted response.
+func sendStatic(res js.Value, key *utils.JWK, jwt string, jres *utils.Response) {
+	b, err := jres.ToJSON()
+	if err != nil {
+		sendError(res, internals.ErrInternal.Wrap(errors.New("error serializing json response: "+err.Error())))
+		return
+	}
+
+	// encrypt the file
+	encrypted, err := key.SymmetricEncrypt(b)
+	if err != nil {
+		sendError(res, internals.ErrInternal.Wrap(errors.New("error encrypting file: "+err.Error())))
+		return
+	}
+
+	// send the response
+	status, statusText := jres.Status, jres.StatusText
+	if status >= 300 && status < 400 {
+		status, statusText = http.StatusOK, http.StatusText(http.StatusOK)
+	}
+	res.Set("statusCode", status)
+	res.Set("statusMessage", statusText)
+	res.Call("set", js.ValueOf(map[string]interface{}{
+		"content-type": "application/json",
+		"mp-JWT":       jwt,
 	}))
+	res.Call("end", js.Global().Get("JSON").Call("stringify", js.ValueOf(map[string]interface{}{
+		"data": base64.URLEncoding.EncodeToString(encrypted),
+	})))
+}
 
-	return nil
+// nodeFS is the Node fs module as an internals.StaticFS. Its lookups await
+// fs.promises.stat, blocking the calling goroutine rather than the event
+// loop, and keep the stats of the paths looked up.
+type nodeFS struct {
+	fs    js.Value
+	stats map[string]js.Value
+}
+
+func (n *nodeFS) Stat(path string) (exists, dir bool) {
+	stat, err := n.stat(path)
+	if err != nil {
+		return false, false
+	}
+	return true, stat.Call("isDirectory").Bool()
+}
+
+// stat returns the fs.Stats of the path
+func (n *nodeFS) stat(path string) (js.Value, error) {
+	if stat, ok := n.stats[path]; ok {
+		return stat, nil
+	}
+	stat, err := awaitPromise(n.fs.Get("promises").Call("stat", path))
+	if err != nil {
+		return js.Undefined(), err
+	}
+	n.stats[path] = stat
+	return stat, nil
+}
+
+// awaitPromise blocks the calling goroutine until the promise settles and
+// returns its value, or its rejection as an error. It must not be called from
+// a JS callback, which would block the event loop the promise settles on.
+func awaitPromise(promise js.Value) (js.Value, error) {
+	var (
+		done   = make(chan struct{})
+		result js.Value
+		err    error
+	)
+	onFulfilled := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		result = args[0]
+		close(done)
+		return nil
+	})
+	onRejected := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		err = errors.New(js.Global().Get("String").Invoke(args[0]).String())
+		close(done)
+		return nil
+	})
+	defer onFulfilled.Release()
+	defer onRejected.Release()
+
+	promise.Call("then", onFulfilled, onRejected)
+	<-done
+	return result, err
 }
 
 func multipart(this js.Value, args []js.Value) interface{} {
@@ -410,9 +785,11 @@ func multipart(this js.Value, args []js.Value) interface{} {
 	single := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		var (
 			req   = args[0]
+			res   = args[1]
 			next  = args[2]
 			field = args[3].String()
 		)
+		defer recoverRequest(res)
 
 		if dest == "" {
 			dest = "tmp"
@@ -463,9 +840,11 @@ func multipart(this js.Value, args []js.Value) interface{} {
 	array := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		var (
 			req   = args[0]
+			res   = args[1]
 			next  = args[2]
 			field = args[3].String()
 		)
+		defer recoverRequest(res)
 
 		if dest == "" {
 			dest = "tmp"
@@ -550,6 +929,45 @@ func async_test_WASM(this js.Value, args []js.Value) interface{} {
 	return promise
 }
 
+// LoadServerKey replaces the server ECDH key pair with the private JWK given
+// as JSON or base64, see internals.ParseServerKey. It returns an error
+// message, or null when the key was loaded.
+func LoadServerKey(this js.Value, args []js.Value) interface{} {
+	if len(args) == 0 || args[0].Type() != js.TypeString {
+		return "server key must be a string"
+	}
+
+	if err := loadServerKey(args[0].String()); err != nil {
+		return err.Error()
+	}
+	return nil
+}
+
+func loadServerKey(raw string) error {
+	pri, pub, err := internals.ParseServerKey(raw)
+	if err != nil {
+		return err
+	}
+	storage.SetServerKeyPair(pri, pub)
+	return nil
+}
+
+// RotateServerKey generates a new server ECDH key pair. The sessions derived
+// from the previous key pair stay valid for the grace period given in
+// milliseconds, storage.DefaultKeyGrace when omitted. It returns an error
+// message, or null when the key was rotated.
+func RotateServerKey(this js.Value, args []js.Value) interface{} {
+	grace := storage.DefaultKeyGrace
+	if len(args) > 0 && args[0].Type() == js.TypeNumber {
+		grace = time.Duration(args[0].Float()) * time.Millisecond
+	}
+
+	if err := storage.RotateServerKey(grace); err != nil {
+		return err.Error()
+	}
+	return nil
+}
+
 func TestWASM(this js.Value, args []js.Value) interface{} {
 	return js.ValueOf("42")
 }
@@ -577,9 +995,23 @@ func getUrlPathFromBody(reqBody map[string]interface{}) string {
 	return ""
 }
 
-func convertBodyToFormdata(reqBody map[string]interface{}) (js.Value, error) {
+// convertBodyToFormdata rebuilds the FormData sent by the interceptor. The
+// files are checked against the limits before they are decoded.
+func convertBodyToFormdata(reqBody map[string]interface{}, limits internals.Limits) (js.Value, error) {
 	formdata := js.Global().Get("FormData").New()
 
+	files := 0
+	for _, v := range reqBody {
+		for _, val := range v.([]interface{}) {
+			if val.(map[string]interface{})["_type"] == "File" {
+				files++
+			}
+		}
+	}
+	if err := limits.CheckFiles(files); err != nil {
+		return js.ValueOf(nil), err
+	}
+
 	for k, v := range reqBody {
 		// formdata can have multiple entries with the same key
 		// that is why each key from the interceptor is a slice
@@ -590,12 +1022,19 @@ func convertBodyToFormdata(reqBody map[string]interface{}) (js.Value, error) {
 
 			switch val["_type"].(string) {
 			case "File":
-				buff, err := base64.StdEncoding.DecodeString(val["buff"].(string))
+				encoded := val["buff"].(string)
+				size := base64.StdEncoding.DecodedLen(len(encoded)) - (len(encoded) - len(strings.TrimRight(encoded, "=")))
+				if err := limits.CheckFileSize(size); err != nil {
+					return js.ValueOf(nil), err
+				}
+
+				buff, err := base64.StdEncoding.DecodeString(encoded)
 				if err != nil {
-					return js.ValueOf(nil), fmt.Errorf("Could not decode file buffer: " + err.Error())
+					return js.ValueOf(nil), internals.ErrInvalidRequest.WithMessage("Could not decode file buffer").Wrap(err)
 				}
 
-				uint8Array := js.Global().Get("Uint8Array").New(val["size"].(float64))
+				// the size announced by the client is not trusted
+				uint8Array := js.Global().Get("Uint8Array").New(len(buff))
 				js.CopyBytesToJS(uint8Array, buff)
 
 				file := js.Global().Get("File").New(
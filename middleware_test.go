@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"syscall/js"
+	"testing"
+	"time"
+
+	"globe-and-citizen/layer8/middleware/internals"
+	"globe-and-citizen/layer8/middleware/storage"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// The tests of the main package run in Node:
+//
+//	GOOS=js GOARCH=wasm go test -exec="$(go env GOROOT)/lib/wasm/go_js_wasm_exec" .
+
+// testSession stores a session for the client and returns its key
+func testSession(t *testing.T, clientUUID string) *utils.JWK {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	key, err := pri.GetECDHSharedSecret(pub)
+	assert.Nil(t, err)
+
+	session := &storage.Session{Key: key, JWT: "jwt", Created: time.Now()}
+	assert.Nil(t, storage.GetInMemStorage().Sessions.Put(clientUUID, session))
+	return key
+}
+
+// testResponse is a fake Express response recording its status, headers and
+// body
+type testResponse struct {
+	js.Value
+	headers js.Value
+	body    string
+	ended   bool
+}
+
+func newTestResponse() *testResponse {
+	res := &testResponse{
+		Value: js.ValueOf(map[string]interface{}{
+			"statusCode":  200,
+			"headersSent": false,
+		}),
+		headers: js.ValueOf(map[string]interface{}{}),
+	}
+	res.Set("setHeader", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		res.headers.Set(strings.ToLower(args[0].String()), args[1])
+		return res.Value
+	}))
+	res.Set("getHeaders", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return res.headers
+	}))
+	res.Set("removeHeader", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		js.Global().Get("Reflect").Call("deleteProperty", res.headers, strings.ToLower(args[0].String()))
+		return nil
+	}))
+	res.Set("set", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return res.Value
+	}))
+	res.Set("write", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return true
+	}))
+	res.Set("end", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 && args[0].Type() == js.TypeString {
+			res.body += args[0].String()
+		}
+		res.ended = true
+		return res.Value
+	}))
+	return res
+}
+
+// tunnelRequest sends the encrypted request through the middleware and
+// reports whether it reached the handlers, calling handler with the response
+// when it is not nil
+func tunnelRequest(t *testing.T, clientUUID string, key *utils.JWK, request *utils.Request, handler func(res js.Value)) (*testResponse, bool) {
+	return tunnelChunks(t, clientUUID, [][]byte{envelope(t, key, request, nil)}, handler)
+}
+
+// envelope returns the body of the encrypted request, with the extra fields
+func envelope(t *testing.T, key *utils.JWK, request *utils.Request, extra map[string]string) []byte {
+	b, err := request.ToJSON()
+	assert.Nil(t, err)
+	encrypted, err := key.SymmetricEncrypt(b)
+	assert.Nil(t, err)
+
+	fields := map[string]string{"data": base64.URLEncoding.EncodeToString(encrypted)}
+	for k, v := range extra {
+		fields[k] = v
+	}
+	body, err := json.Marshal(fields)
+	assert.Nil(t, err)
+	return body
+}
+
+// tunnelChunks sends the body through the middleware in the given chunks, see
+// tunnelRequest
+func tunnelChunks(t *testing.T, clientUUID string, chunks [][]byte, handler func(res js.Value)) (*testResponse, bool) {
+	req := js.Global().Call("require", "events").Get("EventEmitter").New()
+	req.Set("headers", map[string]interface{}{"x-tunnel": "true", "x-client-uuid": clientUUID})
+	req.Set("url", "/")
+	req.Set("query", map[string]interface{}{})
+	noop := js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil })
+	req.Set("resume", noop)
+	req.Set("pause", noop)
+
+	res := newTestResponse()
+	handled := false
+	next := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		handled = true
+		if handler != nil {
+			handler(res.Value)
+		}
+		return nil
+	})
+
+	WASMMiddleware_v2(js.Undefined(), []js.Value{req, res.Value, next.Value})
+	for _, chunk := range chunks {
+		req.Call("emit", "data", nodeBuffer(chunk))
+	}
+	req.Call("emit", "end")
+	return res, handled
+}
+
+// nodeBuffer copies b to a new Buffer
+func nodeBuffer(b []byte) js.Value {
+	array := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(array, b)
+	return js.Global().Get("Buffer").Call("from", array)
+}
+
+// decryptResponse returns the encrypted response the middleware ended res with
+func decryptResponse(t *testing.T, key *utils.JWK, res *testResponse) *internals.Response {
+	var envelope struct {
+		Data string `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(res.body), &envelope))
+	b, err := base64.URLEncoding.DecodeString(envelope.Data)
+	assert.Nil(t, err)
+	b, err = key.SymmetricDecrypt(b)
+	assert.Nil(t, err)
+
+	response := new(internals.Response)
+	assert.Nil(t, json.Unmarshal(b, response))
+	return response
+}
+
+func TestMultipartLimits(t *testing.T) {
+	previous := settings.limits
+	defer func() { settings.limits = previous }()
+	settings.limits = internals.RouteLimits{Limits: internals.Limits{MaxBodySize: 4 << 10}}
+
+	key := testSession(t, "multipart-client")
+
+	// the decrypted body of a multipart request is its form as JSON, with
+	// the files encoded in base64
+	form := func(fileSize int) []byte {
+		b, err := json.Marshal(map[string]interface{}{
+			"path": []map[string]interface{}{{"_type": "String", "value": "/upload"}},
+			"file": []map[string]interface{}{{
+				"_type": "File",
+				"name":  "file.bin",
+				"type":  "application/octet-stream",
+				"size":  fileSize,
+				"buff":  base64.StdEncoding.EncodeToString(make([]byte, fileSize)),
+			}},
+		})
+		assert.Nil(t, err)
+		return b
+	}
+
+	tests := []struct {
+		name           string
+		fileSize       int
+		expectedStatus int // 0 when the request reaches the handlers
+	}{
+		{"under_the_body_limit", 1 << 10, 0},
+		{"over_the_body_limit", 8 << 10, 413},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, handled := tunnelRequest(t, "multipart-client", key, &utils.Request{
+				Method:  "POST",
+				Headers: map[string]string{"Content-Type": "application/layer8.buffer+json"},
+				Body:    form(tt.fileSize),
+			}, nil)
+			if tt.expectedStatus == 0 {
+				assert.True(t, handled)
+				return
+			}
+			assert.False(t, handled)
+			assert.True(t, res.ended)
+			assert.Equal(t, tt.expectedStatus, res.Get("statusCode").Int())
+		})
+	}
+}
+
+func TestUnknownSession(t *testing.T) {
+	key := testSession(t, "known-client")
+
+	// a session derived from a server key that is no longer valid
+	expired := testSession(t, "expired-client")
+	session, err := storage.GetInMemStorage().Sessions.Get("expired-client")
+	assert.Nil(t, err)
+	session.KeyID = "retired-key"
+
+	tests := []struct {
+		name       string
+		clientUUID string
+		key        *utils.JWK
+		rekey      string
+	}{
+		{"unknown_session", "unknown-client", key, "unknown"},
+		{"expired_session", "expired-client", expired, "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, handled := tunnelRequest(t, tt.clientUUID, tt.key, &utils.Request{
+				Method:  "GET",
+				Headers: map[string]string{},
+			}, nil)
+
+			// the data request is not taken for a handshake
+			assert.False(t, handled)
+			assert.True(t, res.ended)
+			assert.Equal(t, internals.StatusSessionUnknown, res.Get("statusCode").Int())
+			assert.Equal(t, string(internals.CodeUnknownSession), res.headers.Get("x-layer8-error").String())
+			assert.Equal(t, tt.rekey, res.headers.Get(rekeyHeader).String())
+			assert.True(t, res.headers.Get("x-server-key-id").IsUndefined())
+		})
+	}
+}
+
+func TestTunnelResponse(t *testing.T) {
+	key := testSession(t, "response-client")
+	buffer := func(args ...interface{}) js.Value {
+		return js.Global().Get("Buffer").Call("from", args...)
+	}
+
+	tests := []struct {
+		name            string
+		handler         func(res js.Value)
+		expectedStatus  int
+		expectedBody    string
+		expectedHeaders map[string]string
+	}{
+		{
+			name:           "send_string",
+			handler:        func(res js.Value) { res.Call("send", "hello") },
+			expectedStatus: 200,
+			expectedBody:   "hello",
+		},
+		{
+			name:           "send_without_body",
+			handler:        func(res js.Value) { res.Call("send") },
+			expectedStatus: 200,
+			expectedBody:   "",
+		},
+		{
+			name:           "send_null",
+			handler:        func(res js.Value) { res.Call("send", js.Null()) },
+			expectedStatus: 200,
+			expectedBody:   "",
+		},
+		{
+			name:           "json_object",
+			handler:        func(res js.Value) { res.Call("json", map[string]interface{}{"ok": true}) },
+			expectedStatus: 200,
+			expectedBody:   `{"ok":true}`,
+		},
+		{
+			name:           "json_null",
+			handler:        func(res js.Value) { res.Call("json", js.Null()) },
+			expectedStatus: 200,
+			expectedBody:   "null",
+		},
+		{
+			name: "write_and_end",
+			handler: func(res js.Value) {
+				res.Call("write", "hello, ")
+				res.Call("write", "tunnel ")
+				res.Call("end", "world")
+			},
+			expectedStatus: 200,
+			expectedBody:   "hello, tunnel world",
+		},
+		{
+			name: "write_and_end_with_encodings",
+			handler: func(res js.Value) {
+				res.Call("write", "aGVsbG8s", "base64")
+				res.Call("end", "20776f726c64", "hex")
+			},
+			expectedStatus: 200,
+			expectedBody:   "hello, world",
+		},
+		{
+			name: "binary_write",
+			handler: func(res js.Value) {
+				res.Call("write", buffer([]interface{}{0, 1, 2, 255}))
+				res.Call("end")
+			},
+			expectedStatus:  200,
+			expectedBody:    "\x00\x01\x02\xff",
+			expectedHeaders: map[string]string{"content-type": "application/octet-stream"},
+		},
+		{
+			name:           "status_chaining",
+			handler:        func(res js.Value) { res.Call("status", 201).Call("send", "created") },
+			expectedStatus: 201,
+			expectedBody:   "created",
+		},
+		{
+			name:           "status_numeric_string",
+			handler:        func(res js.Value) { res.Call("status", "202").Call("send", "accepted") },
+			expectedStatus: 202,
+			expectedBody:   "accepted",
+		},
+		{
+			name:            "send_status",
+			handler:         func(res js.Value) { res.Call("sendStatus", 404) },
+			expectedStatus:  404,
+			expectedBody:    "Not Found",
+			expectedHeaders: map[string]string{"content-type": "text/plain; charset=utf-8"},
+		},
+		{
+			name:           "send_status_numeric_string",
+			handler:        func(res js.Value) { res.Call("sendStatus", "418") },
+			expectedStatus: 418,
+			expectedBody:   "I'm a teapot",
+		},
+		{
+			name: "sent_once",
+			handler: func(res js.Value) {
+				res.Call("send", "first")
+				res.Call("send", "second")
+				res.Call("end", "third")
+			},
+			expectedStatus: 200,
+			expectedBody:   "first",
+		},
+		{
+			name: "handler_headers",
+			handler: func(res js.Value) {
+				res.Call("setHeader", "x-custom", "value")
+				res.Call("setHeader", "set-cookie", "session=secret")
+				res.Call("setHeader", "cache-control", "no-store")
+				res.Call("send", "hello")
+			},
+			expectedStatus: 200,
+			expectedBody:   "hello",
+			expectedHeaders: map[string]string{
+				"x-custom":      "value",
+				"set-cookie":    "session=secret",
+				"cache-control": "no-store",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, handled := tunnelRequest(t, "response-client", key, &utils.Request{
+				Method:  "GET",
+				Headers: map[string]string{},
+			}, tt.handler)
+			assert.True(t, handled)
+			assert.True(t, res.ended)
+
+			// the outer response carries the encrypted one, with its status
+			assert.Equal(t, tt.expectedStatus, res.Get("statusCode").Int())
+			assert.Equal(t, "application/json", res.headers.Get("content-type").String())
+
+			response := decryptResponse(t, key, res)
+			assert.Equal(t, tt.expectedStatus, response.Status)
+			assert.Equal(t, tt.expectedBody, string(response.Body))
+			for k, v := range tt.expectedHeaders {
+				assert.Equal(t, v, response.Headers[k])
+			}
+
+			// the headers of the handler are only in the encrypted response
+			outer := js.Global().Get("Object").Call("keys", res.headers)
+			for i := 0; i < outer.Length(); i++ {
+				assert.Contains(t, []string{"content-type", "mp-jwt"}, outer.Index(i).String())
+			}
+		})
+	}
+}
+
+func TestTunnelResponseInvalidStatus(t *testing.T) {
+	key := testSession(t, "status-client")
+
+	tests := []struct {
+		name    string
+		handler func(res js.Value)
+	}{
+		{"status_not_a_number", func(res js.Value) { res.Call("status", "abc") }},
+		{"status_without_argument", func(res js.Value) { res.Call("status") }},
+		{"status_out_of_range", func(res js.Value) { res.Call("status", 1000) }},
+		{"send_status_undefined", func(res js.Value) { res.Call("sendStatus", js.Undefined()) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, handled := tunnelRequest(t, "status-client", key, &utils.Request{
+				Method:  "GET",
+				Headers: map[string]string{},
+			}, tt.handler)
+			assert.True(t, handled)
+
+			// the request fails in plaintext rather than stopping the runtime
+			assert.True(t, res.ended)
+			assert.Equal(t, 500, res.Get("statusCode").Int())
+			assert.Equal(t, string(internals.CodeInternal), res.headers.Get("x-layer8-error").String())
+		})
+	}
+}
+
+func TestSplitMultiByteCharacter(t *testing.T) {
+	key := testSession(t, "utf8-client")
+	body := envelope(t, key, &utils.Request{
+		Method:  "POST",
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    []byte(`{"text":"こんにちは"}`),
+	}, map[string]string{"locale": "日本語"})
+
+	// the chunks split the first byte of 日 from the rest of it
+	split := bytes.Index(body, []byte("日")) + 1
+	chunks := [][]byte{body[:split], body[split:]}
+
+	// the body is collected as it was sent, not decoded chunk by chunk
+	var collected bytes.Buffer
+	collect := collectBody(js.Global().Call("require", "events").Get("EventEmitter").New(), newTestResponse().Value, &collected)
+	for _, chunk := range chunks {
+		collect.Invoke(nodeBuffer(chunk))
+	}
+	assert.Equal(t, string(body), collected.String())
+
+	res, handled := tunnelChunks(t, "utf8-client", chunks, func(res js.Value) {
+		res.Call("send", "ok")
+	})
+	assert.True(t, handled)
+	assert.Equal(t, "ok", string(decryptResponse(t, key, res).Body))
+}
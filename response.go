@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall/js"
+
+	"globe-and-citizen/layer8/middleware/internals"
+	gojs "globe-and-citizen/layer8/middleware/js"
+	"globe-and-citizen/layer8/middleware/marshaller"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+)
+
+// tunnelResponse encrypts what the route handlers write to a response. It
+// replaces the response writing methods of the Express response so that the
+// payload always goes through internals.PrepareData:
+//   - send, json: encrypt their argument, an empty body when there is none,
+//     binary data when it is a Buffer, a TypedArray or an ArrayBuffer; json
+//     sends null as the JSON literal
+//   - write: buffers the chunk until the response ends, the body is binary
+//     once a Buffer is written, e.g. when a stream is piped to the response
+//   - end: encrypts the buffered chunks followed by its own chunk
+//   - sendStatus: sets the status and encrypts its status text
+//   - status: sets the status, returning the response for chaining; both
+//     take a number or a numeric string, an invalid status fails the request
+//   - redirect: encrypts the redirect, see redirect
+//
+// The response is sent once, later calls are ignored.
+//
+// For streamed requests, see internals.StreamHeader, the response is streamed
+// too: the first write sends the status and the headers in the metadata
+// frame, every write is sent as it comes in its own frames and end sends the
+// final frame. The outer response is a 200 application/octet-stream.
+//
+// The headers set by the handlers are only sent in the encrypted response,
+// see resetHeaders.
+type tunnelResponse struct {
+	res js.Value
+	key *utils.JWK
+	jwt string
+
+	// stream seals the frames of a streamed response, nil otherwise
+	stream *internals.StreamEncrypter
+	// started is set once the metadata frame of a streamed response was sent
+	started bool
+	// writeChunk is the original write method, used to send the frames
+	writeChunk js.Value
+
+	// urlPath is the __url_path of the request, redirects are resolved against it
+	urlPath string
+	// referrer is the Referer header of the request, for redirects to "back"
+	referrer string
+
+	// outerHeaders are the headers set before the response was wrapped, e.g.
+	// by a CORS middleware, the only ones kept on the plaintext response
+	outerHeaders js.Value
+
+	// end is the original end method, used to send the encrypted payload
+	end js.Value
+	// body holds the chunks passed to write
+	body bytes.Buffer
+	// binary is set once a Buffer or a TypedArray was written, the body is
+	// then sent as binary data
+	binary bool
+	sent   bool
+}
+
+// wrapResponse replaces the response writing methods of res, see tunnelResponse.
+// The response is streamed when stream is not nil.
+func wrapResponse(res js.Value, request *utils.Request, urlPath string, key *utils.JWK, jwt string, stream *internals.StreamEncrypter) *tunnelResponse {
+	t := &tunnelResponse{
+		res:        res,
+		key:        key,
+		jwt:        jwt,
+		stream:     stream,
+		urlPath:    urlPath,
+		end:        res.Get("end"),
+		writeChunk: res.Get("write"),
+	}
+	t.outerHeaders = js.Global().Get("Object").New()
+	if res.Get("getHeaders").Type() == js.TypeFunction {
+		js.Global().Get("Object").Call("assign", t.outerHeaders, res.Call("getHeaders"))
+	}
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, "referer") || strings.EqualFold(k, "referrer") {
+			t.referrer = v
+		}
+	}
+
+	send := func(args []js.Value, asJSON bool) interface{} {
+		defer recoverRequest(res)
+
+		switch {
+		case len(args) == 0:
+			t.send(gojs.ValueOf(""))
+		case asJSON && args[0].IsNull():
+			// Express sends the JSON literal, and an empty body for send(null)
+			t.send(gojs.ValueOf("null"))
+		default:
+			t.send(responseBody(args[0]))
+		}
+		return res
+	}
+	res.Set("send", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return send(args, false)
+	}))
+	res.Set("json", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return send(args, true)
+	}))
+
+	res.Set("write", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		if t.sent {
+			println("error writing response: the response was already sent")
+			return false
+		}
+		ok := true
+		if len(args) > 0 {
+			ok = t.write(args[0], optionalArg(args, 1))
+		}
+		callback(args)
+		return ok
+	}))
+
+	res.Set("end", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		if len(args) > 0 && args[0].Type() != js.TypeFunction {
+			t.write(args[0], optionalArg(args, 1))
+		}
+		if t.stream != nil {
+			t.sendStream(nil, false, true)
+		} else if t.binary {
+			t.send(gojs.ValueOf(t.body.Bytes()))
+		} else {
+			t.send(gojs.ValueOf(t.body.String()))
+		}
+		callback(args)
+		return res
+	}))
+
+	res.Set("sendStatus", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		status, err := statusCode(optionalArg(args, 0))
+		if err != nil {
+			t.fail(err)
+			return res
+		}
+		text := http.StatusText(status)
+		if text == "" {
+			text = strconv.Itoa(status)
+		}
+		res.Set("statusCode", status)
+		res.Call("setHeader", "content-type", "text/plain; charset=utf-8")
+		t.send(gojs.ValueOf(text))
+		return res
+	}))
+
+	res.Set("status", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		status, err := statusCode(optionalArg(args, 0))
+		if err != nil {
+			t.fail(err)
+			return res
+		}
+		res.Set("statusCode", status)
+		return res
+	}))
+
+	res.Set("redirect", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer recoverRequest(res)
+
+		// redirect(url), redirect(status, url) and the deprecated redirect(url, status)
+		status, location := http.StatusFound, ""
+		for _, arg := range args {
+			switch arg.Type() {
+			case js.TypeNumber:
+				status = arg.Int()
+			case js.TypeString:
+				location = arg.String()
+			}
+		}
+		t.redirect(status, location)
+		return nil
+	}))
+
+	return t
+}
+
+// redirect sends a redirect to location, resolved against the URL path of the
+// request. The status and the Location header are only sent in the encrypted
+// response, for the interceptor to follow the redirect through the tunnel.
+func (t *tunnelResponse) redirect(status int, location string) {
+	resolved, err := internals.ResolveRedirect(t.urlPath, location, t.referrer)
+	if err != nil {
+		t.fail(internals.ErrInternal.Wrap(err))
+		return
+	}
+
+	t.res.Set("statusCode", status)
+	t.res.Call("setHeader", "location", resolved)
+	t.res.Call("setHeader", "content-type", "text/plain; charset=utf-8")
+	t.send(gojs.ValueOf(http.StatusText(status) + ". Redirecting to " + resolved))
+}
+
+// write handles a chunk passed to write or end, a string in the given
+// encoding or binary data. The chunk is buffered, or sent in frames when the
+// response is streamed; the result is the one of write.
+func (t *tunnelResponse) write(chunk, encoding js.Value) bool {
+	b, binary := chunkBytes(chunk, encoding)
+	if t.stream != nil {
+		return t.sendStream(b, binary, false)
+	}
+
+	t.binary = t.binary || binary
+	t.body.Write(b)
+	return true
+}
+
+// chunkBytes returns the bytes of a chunk passed to write or end, or emitted
+// by the request, and whether it is binary data
+func chunkBytes(chunk, encoding js.Value) ([]byte, bool) {
+	if chunk.Type() == js.TypeString {
+		if encoding.Type() != js.TypeString {
+			return []byte(chunk.String()), false
+		}
+		b, _ := marshaller.Bytes(js.Global().Get("Buffer").Call("from", chunk, encoding))
+		return b, false
+	}
+
+	if b, ok := marshaller.Bytes(chunk); ok {
+		return b, true
+	}
+	if chunk.Truthy() {
+		return []byte(chunk.Call("toString").String()), false
+	}
+	return nil, false
+}
+
+// send encrypts data and ends the response with the encrypted payload
+func (t *tunnelResponse) send(data *gojs.Value) {
+	if t.sent {
+		println("error sending response: the response was already sent")
+		return
+	}
+	if t.stream != nil {
+		b, err := internals.EncodeBody(data)
+		if err != nil {
+			t.fail(err)
+			return
+		}
+		t.sendStream(b, data.Type == gojs.TypeBinary, true)
+		return
+	}
+	t.sent = true
+
+	response, err := internals.PrepareData(responseState(t.res), data, t.key, t.jwt)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	t.res.Set("statusCode", response.Status)
+	t.res.Set("statusMessage", response.StatusText)
+	// a plaintext redirect would be followed outside of the tunnel, the
+	// interceptor follows the one of the encrypted response instead
+	if response.Status >= 300 && response.Status < 400 {
+		t.res.Set("statusCode", http.StatusOK)
+		t.res.Set("statusMessage", http.StatusText(http.StatusOK))
+	}
+	t.resetHeaders()
+	for k, v := range response.Headers {
+		t.res.Call("setHeader", k, v)
+	}
+	t.end.Call("call", t.res, js.Global().Get("JSON").Call("stringify", js.ValueOf(map[string]interface{}{
+		"data": base64.URLEncoding.EncodeToString(response.Body),
+	})))
+}
+
+// sendStream seals b in the next frames of a streamed response, preceded by
+// the stream header and the metadata frame on the first call, and sends them
+// with the original write, or end when final is set. It returns the result of
+// write, false when the client should wait for the drain event.
+func (t *tunnelResponse) sendStream(b []byte, binary, final bool) bool {
+	if t.sent {
+		println("error sending response: the response was already sent")
+		return false
+	}
+
+	var out bytes.Buffer
+	if !t.started {
+		// the content-type of binary bodies is detected from their first chunk
+		var sniff []byte
+		if binary {
+			sniff = b
+		}
+		metadata, err := internals.PrepareStreamMetadata(responseState(t.res), sniff)
+		if err != nil {
+			t.fail(err)
+			return false
+		}
+		frame, err := t.stream.Seal(metadata, false)
+		if err != nil {
+			t.fail(err)
+			return false
+		}
+		out.Write(frame)
+
+		// the status and the headers of the handler are in the metadata frame
+		t.res.Set("statusCode", http.StatusOK)
+		t.res.Set("statusMessage", http.StatusText(http.StatusOK))
+		t.resetHeaders()
+		t.res.Call("setHeader", "content-type", "application/octet-stream")
+		t.res.Call("setHeader", internals.StreamHeader, "1")
+		t.res.Call("setHeader", "mp-JWT", t.jwt)
+		t.started = true
+	}
+
+	frame, err := t.stream.Seal(b, final)
+	if err != nil {
+		t.fail(err)
+		return false
+	}
+	out.Write(frame)
+
+	if final {
+		t.sent = true
+		t.end.Call("call", t.res, bytesToJS(out.Bytes()))
+		return true
+	}
+	if out.Len() == 0 {
+		return true
+	}
+	return t.writeChunk.Call("call", t.res, bytesToJS(out.Bytes())).Bool()
+}
+
+// fail ends the response with err, see sendError. A streamed response whose
+// frames were partly sent is ended without its final frame instead, which the
+// interceptor reports as a truncated stream.
+func (t *tunnelResponse) fail(err error) {
+	t.sent = true
+	if t.started {
+		println("error streaming response:", err.Error())
+		t.end.Call("call", t.res)
+		return
+	}
+	t.res.Set("end", t.end)
+	t.resetHeaders()
+	sendError(t.res, err)
+}
+
+// resetHeaders removes the headers set by the handlers from the plaintext
+// response, once they were captured for the encrypted one: cookies, caching
+// or content headers must not apply outside of the tunnel. The headers set
+// before the response was wrapped are restored.
+func (t *tunnelResponse) resetHeaders() {
+	if t.res.Get("getHeaders").Type() != js.TypeFunction || t.res.Get("headersSent").Truthy() {
+		return
+	}
+	object := js.Global().Get("Object")
+	names := object.Call("keys", t.res.Call("getHeaders"))
+	for i := 0; i < names.Length(); i++ {
+		t.res.Call("removeHeader", names.Index(i))
+	}
+	names = object.Call("keys", t.outerHeaders)
+	for i := 0; i < names.Length(); i++ {
+		t.res.Call("setHeader", names.Index(i), t.outerHeaders.Get(names.Index(i).String()))
+	}
+}
+
+// bytesToJS copies b to a new Uint8Array
+func bytesToJS(b []byte) js.Value {
+	array := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(array, b)
+	return array
+}
+
+// responseState returns the status and the headers of the response as
+// PrepareData expects them. Express keeps the headers in an object without
+// prototype, returned by getHeaders, which is copied for marshaller.Unmarshal.
+func responseState(res js.Value) *gojs.Value {
+	state := map[string]*gojs.Value{
+		"statusCode": gojs.ValueOf(res.Get("statusCode").Float()),
+		"headers":    gojs.ValueOf(map[string]interface{}{}),
+	}
+	if statusMessage := res.Get("statusMessage"); statusMessage.Type() == js.TypeString {
+		state["statusText"] = gojs.ValueOf(statusMessage.String())
+	}
+	if res.Get("getHeaders").Type() == js.TypeFunction {
+		object := js.Global().Get("Object")
+		state["headers"] = marshaller.Unmarshal(object.Call("assign", object.New(), res.Call("getHeaders")))
+	}
+	return &gojs.Value{
+		Type:        gojs.TypeObject,
+		Constructor: "Object",
+		Value:       state,
+	}
+}
+
+// responseBody converts the argument of send or json, null and undefined
+// being an empty body
+func responseBody(v js.Value) *gojs.Value {
+	switch v.Type() {
+	case js.TypeString:
+		// stringified JSON is sent as it is rather than decoded and encoded
+		// again, which would lose the precision of its large numbers
+		return gojs.ValueOf(v.String())
+	case js.TypeNumber:
+		return gojs.ValueOf(v.Float())
+	case js.TypeBoolean:
+		return gojs.ValueOf(v.Bool())
+	case js.TypeUndefined, js.TypeNull:
+		return gojs.ValueOf("")
+	}
+	return marshaller.Unmarshal(v)
+}
+
+// statusCode converts the argument of status or sendStatus as Express does,
+// numeric strings included. Anything but an integer from 100 to 999 is an
+// ErrInternal, the handler being at fault.
+func statusCode(v js.Value) (int, error) {
+	n := js.Global().Get("Number").Invoke(v).Float()
+	if n != math.Trunc(n) || n < 100 || n > 999 {
+		return 0, internals.ErrInternal.Wrap(errors.New("invalid status code: " + js.Global().Get("String").Invoke(v).String()))
+	}
+	return int(n), nil
+}
+
+// optionalArg returns the i-th argument, undefined when it is not given
+func optionalArg(args []js.Value, i int) js.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return js.Undefined()
+}
+
+// callback calls the callback given as the last argument of write or end
+func callback(args []js.Value) {
+	if len(args) > 0 && args[len(args)-1].Type() == js.TypeFunction {
+		args[len(args)-1].Invoke()
+	}
+}
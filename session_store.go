@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall/js"
+
+	"globe-and-citizen/layer8/middleware/storage"
+)
+
+// jsSessionStore adapts a session store implemented in JavaScript to the
+// storage.SessionStore interface. The JavaScript object must expose the
+// synchronous methods:
+//
+//	get(clientUUID) => string | null | undefined
+//	put(clientUUID, session: string) => void
+//	delete(clientUUID) => void
+//	touch(clientUUID) => void
+//
+// and may expose acceptSeq(clientUUID, seq: number) => boolean to record the
+// sequence numbers of replay protection atomically, see storage.ReplayStore.
+//
+// Sessions are handed to the store serialized as JSON strings.
+type jsSessionStore struct {
+	store js.Value
+}
+
+// jsReplaySessionStore is a jsSessionStore exposing acceptSeq()
+type jsReplaySessionStore struct {
+	*jsSessionStore
+}
+
+func newJSSessionStore(store js.Value) (storage.SessionStore, error) {
+	for _, method := range []string{"get", "put", "delete", "touch"} {
+		if store.Get(method).Type() != js.TypeFunction {
+			return nil, fmt.Errorf("session store must implement %s()", method)
+		}
+	}
+	if store.Get("acceptSeq").Type() == js.TypeFunction {
+		return jsReplaySessionStore{&jsSessionStore{store: store}}, nil
+	}
+	return &jsSessionStore{store: store}, nil
+}
+
+// call invokes a method of the store, turning thrown JavaScript errors into Go errors
+func (s *jsSessionStore) call(method string, args ...interface{}) (result js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("session store %s() failed: %v", method, r)
+		}
+	}()
+	return s.store.Call(method, args...), nil
+}
+
+func (s *jsSessionStore) Get(clientUUID string) (*storage.Session, error) {
+	v, err := s.call("get", clientUUID)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsNull() || v.IsUndefined() {
+		return nil, storage.ErrSessionNotFound
+	}
+	if v.Type() != js.TypeString {
+		return nil, fmt.Errorf("session store get() must return a string, got %s", v.Type().String())
+	}
+
+	session := new(storage.Session)
+	if err := json.Unmarshal([]byte(v.String()), session); err != nil {
+		return nil, fmt.Errorf("could not decode session: %s", err.Error())
+	}
+	return session, nil
+}
+
+func (s *jsSessionStore) Put(clientUUID string, session *storage.Session) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("could not encode session: %s", err.Error())
+	}
+	_, err = s.call("put", clientUUID, string(b))
+	return err
+}
+
+func (s *jsSessionStore) Delete(clientUUID string) error {
+	_, err := s.call("delete", clientUUID)
+	return err
+}
+
+func (s *jsSessionStore) Touch(clientUUID string) error {
+	_, err := s.call("touch", clientUUID)
+	return err
+}
+
+func (s jsReplaySessionStore) AcceptSeq(clientUUID string, seq uint64) (bool, error) {
+	v, err := s.call("acceptSeq", clientUUID, float64(seq))
+	if err != nil {
+		return false, err
+	}
+	if v.Type() != js.TypeBoolean {
+		return false, fmt.Errorf("session store acceptSeq() must return a boolean, got %s", v.Type().String())
+	}
+	return v.Bool(), nil
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+)
+
+// DefaultKeyGrace is how long a rotated server key keeps its sessions valid
+// when no grace period is given
+var DefaultKeyGrace = time.Hour
+
+type serverKey struct {
+	pri *utils.JWK
+	pub *utils.JWK
+	// retiresAt is when the sessions derived from a rotated key expire
+	retiresAt time.Time
+}
+
+// ecdh holds the current server key pair and the previous ones that are
+// still within their grace period after a rotation
+type ecdh struct {
+	mu       sync.RWMutex
+	current  serverKey
+	previous []serverKey
+	now      func() time.Time
+}
+
+var (
+	// rotationStop stops the scheduled key rotation, nil when none is running
+	rotationStop chan struct{}
+	rotationMu   sync.Mutex
+)
+
+func newECDH(pri, pub *utils.JWK) *ecdh {
+	return &ecdh{
+		current: serverKey{pri: pri, pub: pub},
+		now:     time.Now,
+	}
+}
+
+// KeyID returns the id shared by the private and the public key of a pair
+func KeyID(key *utils.JWK) string {
+	if key == nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(key.Kid, "priv_"), "pub_")
+}
+
+func (e *ecdh) GetPrivateKey() *utils.JWK {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.current.pri
+}
+
+func (e *ecdh) GetPublicKey() *utils.JWK {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.current.pub
+}
+
+// GetKeyID returns the id of the current key pair
+func (e *ecdh) GetKeyID() string {
+	return KeyID(e.GetPublicKey())
+}
+
+// set replaces the current key pair and drops the previous ones
+func (e *ecdh) set(pri, pub *utils.JWK) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.current = serverKey{pri: pri, pub: pub}
+	e.previous = nil
+}
+
+// rotate makes pri and pub the current key pair, the previous one stays
+// valid for the grace period
+func (e *ecdh) rotate(pri, pub *utils.JWK, grace time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	retired := e.current
+	retired.retiresAt = now.Add(grace)
+
+	previous := []serverKey{retired}
+	for _, k := range e.previous {
+		if now.Before(k.retiresAt) {
+			previous = append(previous, k)
+		}
+	}
+	e.current = serverKey{pri: pri, pub: pub}
+	e.previous = previous
+}
+
+// keys returns a copy of the current and of the previous key pairs
+func (e *ecdh) keys() (serverKey, []serverKey) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.current, append([]serverKey{}, e.previous...)
+}
+
+// IsValid reports whether sessions derived from the key with this id are
+// still accepted
+func (e *ecdh) IsValid(keyID string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if keyID == KeyID(e.current.pub) {
+		return true
+	}
+	now := e.now()
+	for _, k := range e.previous {
+		if keyID == KeyID(k.pub) {
+			return now.Before(k.retiresAt)
+		}
+	}
+	return false
+}
+
+// RotateServerKey generates a new server key pair. Sessions derived from the
+// previous key pair stay valid for the grace period.
+func RotateServerKey(grace time.Duration) error {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	if err != nil {
+		return err
+	}
+
+	s := inMemStorageInstance
+	s.ECDH.rotate(pri, pub, grace)
+	if s.persistence != nil {
+		s.scheduleSave()
+	}
+	return nil
+}
+
+// StartKeyRotation rotates the server key pair every interval, replacing any
+// schedule started before. A zero interval stops the rotation.
+func StartKeyRotation(interval, grace time.Duration) {
+	StopKeyRotation()
+	if interval <= 0 {
+		return
+	}
+
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	ticker, stop := time.NewTicker(interval), make(chan struct{})
+	rotationStop = stop
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := RotateServerKey(grace); err != nil {
+					println("error rotating server key:", err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopKeyRotation stops the scheduled rotation of the server key pair
+func StopKeyRotation() {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	if rotationStop != nil {
+		close(rotationStop)
+		rotationStop = nil
+	}
+}
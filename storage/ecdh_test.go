@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRotation(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	assert.Nil(t, InitInMemStorage(pri, pub))
+
+	db := GetInMemStorage()
+	now := time.Now()
+	db.ECDH.now = func() time.Time { return now }
+
+	oldKeyID := db.ECDH.GetKeyID()
+	assert.Equal(t, KeyID(pub), oldKeyID)
+
+	session := newTestSession(t, "jwt")
+	session.KeyID = oldKeyID
+	assert.Nil(t, db.Sessions.Put("client", session))
+
+	assert.Nil(t, RotateServerKey(time.Minute))
+	assert.NotEqual(t, oldKeyID, db.ECDH.GetKeyID())
+	assert.NotEqual(t, pri, db.ECDH.GetPrivateKey())
+
+	// the session derived from the rotated key is valid during the grace period
+	assert.True(t, db.ECDH.IsValid(oldKeyID))
+	got, err := db.GetSession("client")
+	assert.Nil(t, err)
+	assert.Equal(t, session, got)
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, db.ECDH.IsValid(oldKeyID))
+	assert.True(t, db.ECDH.IsValid(db.ECDH.GetKeyID()))
+	_, err = db.GetSession("client")
+	assert.Equal(t, ErrSessionExpired, err)
+	_, err = db.Sessions.Get("client")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	assert.False(t, db.ECDH.IsValid("unknown"))
+}
+
+func TestSetServerKeyPairDropsPreviousKeys(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	assert.Nil(t, InitInMemStorage(pri, pub))
+
+	assert.Nil(t, RotateServerKey(time.Hour))
+	assert.True(t, GetInMemStorage().ECDH.IsValid(KeyID(pub)))
+
+	pri2, pub2, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	SetServerKeyPair(pri2, pub2)
+
+	assert.False(t, GetInMemStorage().ECDH.IsValid(KeyID(pub)))
+	assert.Equal(t, KeyID(pub2), GetInMemStorage().ECDH.GetKeyID())
+}
+
+func TestStartKeyRotation(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	assert.Nil(t, InitInMemStorage(pri, pub))
+
+	StartKeyRotation(10*time.Millisecond, time.Hour)
+	defer StopKeyRotation()
+
+	assert.Eventually(t, func() bool {
+		return GetInMemStorage().ECDH.GetKeyID() != KeyID(pub)
+	}, time.Second, 5*time.Millisecond)
+	assert.True(t, GetInMemStorage().ECDH.IsValid(KeyID(pub)))
+}
+
+func TestPersistenceKeepsPreviousKeys(t *testing.T) {
+	SaveDelay = 0
+
+	persistence := &Persistence{Persister: new(memPersister), Secret: []byte("secret")}
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	assert.Nil(t, InitInMemStorage(pri, pub, WithPersistence(persistence)))
+
+	assert.Nil(t, RotateServerKey(time.Hour))
+	currentKeyID := GetInMemStorage().ECDH.GetKeyID()
+
+	assert.Nil(t, InitInMemStorage(pri, pub, WithPersistence(persistence)))
+	assert.Equal(t, currentKeyID, GetInMemStorage().ECDH.GetKeyID())
+	assert.True(t, GetInMemStorage().ECDH.IsValid(KeyID(pub)))
+}
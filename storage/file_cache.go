@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFileCacheMaxBytes is the default total size of the cached files
+	DefaultFileCacheMaxBytes = 32 << 20
+	// DefaultFileCacheMaxEntries is the default number of cached files
+	DefaultFileCacheMaxEntries = 1000
+)
+
+// FileCacheOptions bounds a FileCache, the zero values use the defaults
+type FileCacheOptions struct {
+	// MaxBytes is the total size of the cached contents, larger files are not
+	// cached
+	MaxBytes int
+	// MaxEntries is the number of cached files
+	MaxEntries int
+}
+
+// CachedFile is the content of a static file along with its entity tag
+type CachedFile struct {
+	Content []byte
+	ETag    string
+}
+
+type fileEntry struct {
+	path    string
+	modTime time.Time
+	size    int64
+	file    *CachedFile
+}
+
+// FileCache keeps the contents of the static files in memory, evicting the
+// least recently used ones past its limits. An entry is keyed by the path of
+// the file and valid for its modification time and size only: a modified
+// file is read again.
+type FileCache struct {
+	mu      sync.Mutex
+	options FileCacheOptions
+	index   map[string]*list.Element
+	lru     *list.List
+	bytes   int
+}
+
+// NewFileCache returns an empty FileCache
+func NewFileCache(options FileCacheOptions) *FileCache {
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultFileCacheMaxBytes
+	}
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = DefaultFileCacheMaxEntries
+	}
+	return &FileCache{
+		options: options,
+		index:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the cached file at path if it was cached for the same
+// modification time and size. A stale entry is dropped.
+func (c *FileCache) Get(path string, modTime time.Time, size int64) (*CachedFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.index[path]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*fileEntry)
+	if !e.modTime.Equal(modTime) || e.size != size {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.file, true
+}
+
+// Put caches the file at path for its modification time and size, evicting
+// the least recently used files to make room. Files larger than MaxBytes are
+// not cached.
+func (c *FileCache) Put(path string, modTime time.Time, size int64, file *CachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.index[path]; ok {
+		c.remove(el)
+	}
+	if len(file.Content) > c.options.MaxBytes {
+		return
+	}
+
+	for c.lru.Len() > 0 && (c.lru.Len() >= c.options.MaxEntries || c.bytes+len(file.Content) > c.options.MaxBytes) {
+		c.remove(c.lru.Back())
+	}
+	c.index[path] = c.lru.PushFront(&fileEntry{path: path, modTime: modTime, size: size, file: file})
+	c.bytes += len(file.Content)
+}
+
+// Invalidate drops the cached file at path
+func (c *FileCache) Invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.index[path]; ok {
+		c.remove(el)
+	}
+}
+
+// Clear drops every cached file
+func (c *FileCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+// Len returns the number of cached files and their total size
+func (c *FileCache) Len() (entries, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len(), c.bytes
+}
+
+func (c *FileCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*fileEntry)
+	delete(c.index, e.path)
+	c.bytes -= len(e.file.Content)
+}
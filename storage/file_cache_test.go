@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cachedFile(content string) *CachedFile {
+	return &CachedFile{Content: []byte(content), ETag: `"` + content + `"`}
+}
+
+func TestFileCache(t *testing.T) {
+	cache := NewFileCache(FileCacheOptions{})
+	modTime := time.Now()
+
+	file, ok := cache.Get("public/index.html", modTime, 5)
+	assert.False(t, ok)
+	assert.Nil(t, file)
+
+	cache.Put("public/index.html", modTime, 5, cachedFile("hello"))
+	file, ok = cache.Get("public/index.html", modTime, 5)
+	assert.True(t, ok)
+	assert.Equal(t, cachedFile("hello"), file)
+
+	// a modified file is stale
+	_, ok = cache.Get("public/index.html", modTime.Add(time.Second), 5)
+	assert.False(t, ok)
+	_, ok = cache.Get("public/index.html", modTime, 5)
+	assert.False(t, ok, "the stale entry is dropped")
+
+	cache.Put("public/index.html", modTime, 5, cachedFile("hello"))
+	_, ok = cache.Get("public/index.html", modTime, 6)
+	assert.False(t, ok, "a file of another size is stale")
+
+	cache.Put("public/a.css", modTime, 1, cachedFile("a"))
+	cache.Put("public/b.css", modTime, 1, cachedFile("b"))
+	cache.Invalidate("public/a.css")
+	_, ok = cache.Get("public/a.css", modTime, 1)
+	assert.False(t, ok)
+	entries, bytes := cache.Len()
+	assert.Equal(t, 1, entries)
+	assert.Equal(t, 1, bytes)
+
+	cache.Clear()
+	entries, bytes = cache.Len()
+	assert.Equal(t, 0, entries)
+	assert.Equal(t, 0, bytes)
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	modTime := time.Now()
+
+	t.Run("max_entries", func(t *testing.T) {
+		cache := NewFileCache(FileCacheOptions{MaxEntries: 2})
+		cache.Put("a", modTime, 1, cachedFile("a"))
+		cache.Put("b", modTime, 1, cachedFile("b"))
+		// a is now the most recently used file
+		_, ok := cache.Get("a", modTime, 1)
+		assert.True(t, ok)
+
+		cache.Put("c", modTime, 1, cachedFile("c"))
+		_, ok = cache.Get("b", modTime, 1)
+		assert.False(t, ok, "the least recently used file is evicted")
+		_, ok = cache.Get("a", modTime, 1)
+		assert.True(t, ok)
+		_, ok = cache.Get("c", modTime, 1)
+		assert.True(t, ok)
+	})
+
+	t.Run("max_bytes", func(t *testing.T) {
+		cache := NewFileCache(FileCacheOptions{MaxBytes: 10})
+		cache.Put("a", modTime, 4, cachedFile("aaaa"))
+		cache.Put("b", modTime, 4, cachedFile("bbbb"))
+		cache.Put("c", modTime, 4, cachedFile("cccc"))
+
+		entries, bytes := cache.Len()
+		assert.Equal(t, 2, entries)
+		assert.Equal(t, 8, bytes)
+		_, ok := cache.Get("a", modTime, 4)
+		assert.False(t, ok)
+
+		// files larger than the cache are not cached
+		cache.Put("large", modTime, 11, cachedFile(strings.Repeat("l", 11)))
+		_, ok = cache.Get("large", modTime, 11)
+		assert.False(t, ok)
+		entries, _ = cache.Len()
+		assert.Equal(t, 2, entries)
+	})
+}
@@ -1,56 +1,287 @@
 package storage
 
 import (
+	"container/heap"
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
 	utils "github.com/globe-and-citizen/layer8-utils"
 )
 
-type (
-	ecdh struct {
-		pri *utils.JWK
-		pub *utils.JWK
+// SessionOptions bounds the lifetime and the number of sessions kept by the
+// in-memory store. Zero values disable the corresponding limit.
+type SessionOptions struct {
+	// TTL is the maximum lifetime of a session, counted from the handshake
+	TTL time.Duration
+	// IdleTimeout expires sessions that have not been used for this long
+	IdleTimeout time.Duration
+	// MaxSessions caps the number of sessions, evicting the least recently used
+	MaxSessions int
+}
+
+type sessionEntry struct {
+	clientUUID string
+	session    *Session
+	lastSeen   time.Time
+	// ttlIndex is the index of the entry in the TTL heap, -1 when it is not in it
+	ttlIndex int
+}
+
+// ttlHeap orders the sessions by creation time, the oldest first, for the
+// TTL expiry of sessions that are never looked up again
+type ttlHeap []*sessionEntry
+
+func (h ttlHeap) Len() int           { return len(h) }
+func (h ttlHeap) Less(i, j int) bool { return h[i].session.Created.Before(h[j].session.Created) }
+
+func (h ttlHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].ttlIndex, h[j].ttlIndex = i, j
+}
+
+func (h *ttlHeap) Push(x interface{}) {
+	e := x.(*sessionEntry)
+	e.ttlIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *ttlHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.ttlIndex = -1
+	return e
+}
+
+// inMemSessionStore is the default SessionStore. It keeps the sessions in
+// memory and expires them according to its SessionOptions.
+//
+// Sessions are indexed by client UUID for constant time lookups and kept in a
+// list ordered from the most to the least recently used one, which makes
+// idle expiry and LRU eviction work from the back of the list. When a TTL is
+// set, the sessions are also kept in a heap ordered by creation time.
+type inMemSessionStore struct {
+	mu      sync.Mutex
+	options SessionOptions
+	index   map[string]*list.Element
+	lru     *list.List
+	ttl     ttlHeap
+	now     func() time.Time
+
+	// onChange, when set, is called after a session is added or removed
+	onChange func()
+}
+
+// NewInMemSessionStore returns an empty in-memory SessionStore
+func NewInMemSessionStore(options SessionOptions) SessionStore {
+	return &inMemSessionStore{
+		options: options,
+		index:   make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
 	}
-	keys []map[string]*utils.JWK
-	jwts []map[string]string
-)
+}
 
-func (e *ecdh) GetPrivateKey() *utils.JWK {
-	return e.pri
+func (s *inMemSessionStore) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+func (s *inMemSessionStore) remove(el *list.Element) {
+	e := s.lru.Remove(el).(*sessionEntry)
+	delete(s.index, e.clientUUID)
+	s.untrack(e)
 }
 
-func (e *ecdh) GetPublicKey() *utils.JWK {
-	return e.pub
+// track adds the entry to the TTL heap, sessions without a creation time
+// never expire by TTL
+func (s *inMemSessionStore) track(e *sessionEntry) {
+	e.ttlIndex = -1
+	if s.options.TTL > 0 && !e.session.Created.IsZero() {
+		heap.Push(&s.ttl, e)
+	}
 }
 
-func (k *keys) Add(key string, value *utils.JWK) {
-	*k = append(*k, map[string]*utils.JWK{key: value})
+// untrack removes the entry from the TTL heap
+func (s *inMemSessionStore) untrack(e *sessionEntry) {
+	if e.ttlIndex >= 0 {
+		heap.Remove(&s.ttl, e.ttlIndex)
+	}
 }
 
-func (k *keys) Get(key string) *utils.JWK {
-	for _, v := range *k {
-		if jwk, ok := v[key]; ok {
-			return jwk
+func (s *inMemSessionStore) expired(e *sessionEntry, now time.Time) bool {
+	if s.options.TTL > 0 && !e.session.Created.IsZero() && now.Sub(e.session.Created) > s.options.TTL {
+		return true
+	}
+	if s.options.IdleTimeout > 0 && now.Sub(e.lastSeen) > s.options.IdleTimeout {
+		return true
+	}
+	return false
+}
+
+// prune drops the sessions past their TTL, the idle sessions and, when the
+// store is full, the least recently used ones until there is room for one
+// more session
+func (s *inMemSessionStore) prune(now time.Time) {
+	for len(s.ttl) > 0 && now.Sub(s.ttl[0].session.Created) > s.options.TTL {
+		s.remove(s.index[s.ttl[0].clientUUID])
+	}
+
+	if s.options.IdleTimeout > 0 {
+		for el := s.lru.Back(); el != nil && now.Sub(el.Value.(*sessionEntry).lastSeen) > s.options.IdleTimeout; el = s.lru.Back() {
+			s.remove(el)
 		}
 	}
+
+	if s.options.MaxSessions <= 0 {
+		return
+	}
+	for s.lru.Len() >= s.options.MaxSessions {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *inMemSessionStore) Get(clientUUID string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.index[clientUUID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	e := el.Value.(*sessionEntry)
+	if s.expired(e, s.now()) {
+		s.remove(el)
+		return nil, ErrSessionExpired
+	}
+	return e.session, nil
+}
+
+func (s *inMemSessionStore) Put(clientUUID string, session *Session) error {
+	defer s.changed()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// a new handshake overwrites the previous session of the client
+	if el, ok := s.index[clientUUID]; ok {
+		e := el.Value.(*sessionEntry)
+		s.untrack(e)
+		e.session = session
+		e.lastSeen = now
+		s.track(e)
+		s.lru.MoveToFront(el)
+		return nil
+	}
+
+	s.prune(now)
+	e := &sessionEntry{
+		clientUUID: clientUUID,
+		session:    session,
+		lastSeen:   now,
+	}
+	s.index[clientUUID] = s.lru.PushFront(e)
+	s.track(e)
 	return nil
 }
 
-func (j *jwts) Add(key string, value string) {
-	*j = append(*j, map[string]string{key: value})
+func (s *inMemSessionStore) Delete(clientUUID string) error {
+	defer s.changed()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.index[clientUUID]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+// Touch does not call onChange: the time a session was last used is saved
+// with the next snapshot, rather than every request scheduling one
+func (s *inMemSessionStore) Touch(clientUUID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.index[clientUUID]; ok {
+		el.Value.(*sessionEntry).lastSeen = s.now()
+		s.lru.MoveToFront(el)
+	}
+	return nil
 }
 
-func (j *jwts) Get(key string) string {
-	for _, v := range *j {
-		if jwt, ok := v[key]; ok {
-			return jwt
+// sessions returns the sessions that have not expired along with the time
+// they were last used, keyed by client UUID
+func (s *inMemSessionStore) sessions() map[string]*persistedSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	sessions := make(map[string]*persistedSession, s.lru.Len())
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*sessionEntry); !s.expired(e, now) {
+			sessions[e.clientUUID] = &persistedSession{Session: e.session, LastSeen: e.lastSeen}
 		}
 	}
-	return ""
+	return sessions
+}
+
+// restore adds sessions, e.g. loaded from a snapshot, from the least to the
+// most recently used one. Sessions saved without the time they were last
+// used are restored as if they were just used.
+func (s *inMemSessionStore) restore(sessions map[string]*persistedSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	clientUUIDs := make([]string, 0, len(sessions))
+	for clientUUID, session := range sessions {
+		if session == nil || session.Session == nil {
+			continue
+		}
+		if session.LastSeen.IsZero() || session.LastSeen.After(now) {
+			session.LastSeen = now
+		}
+		clientUUIDs = append(clientUUIDs, clientUUID)
+	}
+	sort.Slice(clientUUIDs, func(i, j int) bool {
+		return sessions[clientUUIDs[i]].LastSeen.Before(sessions[clientUUIDs[j]].LastSeen)
+	})
+
+	for _, clientUUID := range clientUUIDs {
+		if _, ok := s.index[clientUUID]; ok {
+			continue
+		}
+		e := &sessionEntry{
+			clientUUID: clientUUID,
+			session:    sessions[clientUUID].Session,
+			lastSeen:   sessions[clientUUID].LastSeen,
+		}
+		if s.expired(e, now) {
+			continue
+		}
+		s.prune(now)
+		s.index[clientUUID] = s.lru.PushFront(e)
+		s.track(e)
+	}
 }
 
 type inMemStorage struct {
-	ECDH *ecdh
-	Keys keys
-	JWTs jwts
+	ECDH     *ecdh
+	Sessions SessionStore
+	// sessionTTL is the TTL of the session options, enforced by GetSession
+	// whatever the store
+	sessionTTL time.Duration
+
+	persistence *Persistence
+	saveMu      sync.Mutex
+	saveTimer   *time.Timer
 }
 
 var (
@@ -58,17 +289,93 @@ var (
 	inMemStorageInstance *inMemStorage
 )
 
-func InitInMemStorage(pri, pub *utils.JWK) {
-	inMemStorageInstance = &inMemStorage{
-		ECDH: &ecdh{
-			pri: pri,
-			pub: pub,
-		},
-		Keys: []map[string]*utils.JWK{},
-		JWTs: []map[string]string{},
+// Option configures the storage created by InitInMemStorage
+type Option func(*inMemStorage)
+
+// WithSessionOptions sets the limits of the in-memory session store. The TTL
+// also applies to the stores set with SetSessionStore.
+func WithSessionOptions(options SessionOptions) Option {
+	return func(s *inMemStorage) {
+		s.Sessions = NewInMemSessionStore(options)
+		s.sessionTTL = options.TTL
+	}
+}
+
+// WithPersistence saves the server key pair and the sessions through the
+// persistence and reloads them on initialization
+func WithPersistence(persistence *Persistence) Option {
+	return func(s *inMemStorage) {
+		s.persistence = persistence
 	}
 }
 
+// InitInMemStorage initializes the storage with the server key pair. When a
+// persisted snapshot exists, its key pair and sessions replace pri and pub.
+func InitInMemStorage(pri, pub *utils.JWK, options ...Option) error {
+	if previous := inMemStorageInstance; previous != nil {
+		previous.saveMu.Lock()
+		if previous.saveTimer != nil {
+			previous.saveTimer.Stop()
+		}
+		previous.saveMu.Unlock()
+	}
+
+	s := &inMemStorage{
+		ECDH:     newECDH(pri, pub),
+		Sessions: NewInMemSessionStore(SessionOptions{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	inMemStorageInstance = s
+
+	if s.persistence == nil {
+		return nil
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	if store, ok := s.Sessions.(*inMemSessionStore); ok {
+		store.onChange = s.scheduleSave
+	}
+	return nil
+}
+
 func GetInMemStorage() *inMemStorage {
 	return inMemStorageInstance
 }
+
+// SetServerKeyPair replaces the server ECDH key pair. Unlike a rotation, the
+// sessions derived from the replaced key pairs are no longer accepted.
+func SetServerKeyPair(pri, pub *utils.JWK) {
+	inMemStorageInstance.ECDH.set(pri, pub)
+	if inMemStorageInstance.persistence != nil {
+		inMemStorageInstance.scheduleSave()
+	}
+}
+
+// GetSession returns the session of the client from the session store. It
+// returns ErrSessionExpired when the session is older than the session TTL or
+// was derived from a server key that is no longer valid.
+func (s *inMemStorage) GetSession(clientUUID string) (*Session, error) {
+	session, err := s.Sessions.Get(clientUUID)
+	if err != nil {
+		return nil, err
+	}
+	expired := s.sessionTTL > 0 && !session.Created.IsZero() && time.Since(session.Created) > s.sessionTTL
+	if expired || session.KeyID != "" && !s.ECDH.IsValid(session.KeyID) {
+		if err := s.Sessions.Delete(clientUUID); err != nil {
+			println("error deleting session:", err.Error())
+		}
+		return nil, ErrSessionExpired
+	}
+	return session, nil
+}
+
+// SetSessionStore replaces the store used to keep the client sessions.
+// Sessions held by the previous store are not migrated, and only the
+// in-memory store is persisted. The session TTL still applies, see
+// GetSession.
+func SetSessionStore(store SessionStore) {
+	inMemStorageInstance.Sessions = store
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSession(t *testing.T, jwt string) *Session {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+
+	key, err := pri.GetECDHSharedSecret(pub)
+	assert.Nil(t, err)
+
+	return &Session{Key: key, JWT: jwt, Created: time.Now()}
+}
+
+// newTestStore returns an in-memory store whose clock is advanced manually
+func newTestStore(options SessionOptions) (*inMemSessionStore, *time.Time) {
+	now := time.Now()
+	store := NewInMemSessionStore(options).(*inMemSessionStore)
+	store.now = func() time.Time { return now }
+	return store, &now
+}
+
+func TestInMemSessionStore(t *testing.T) {
+	store := NewInMemSessionStore(SessionOptions{})
+
+	session, err := store.Get("client")
+	assert.Nil(t, session)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	first := newTestSession(t, "first")
+	assert.Nil(t, store.Put("client", first))
+
+	session, err = store.Get("client")
+	assert.Nil(t, err)
+	assert.Equal(t, first, session)
+
+	// a new handshake replaces the previous session
+	second := newTestSession(t, "second")
+	assert.Nil(t, store.Put("client", second))
+
+	session, err = store.Get("client")
+	assert.Nil(t, err)
+	assert.Equal(t, second, session)
+
+	assert.Nil(t, store.Touch("client"))
+
+	assert.Nil(t, store.Delete("client"))
+	session, err = store.Get("client")
+	assert.Nil(t, session)
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestInMemSessionStoreTTL(t *testing.T) {
+	store, now := newTestStore(SessionOptions{TTL: time.Minute})
+
+	session := newTestSession(t, "jwt")
+	session.Created = *now
+	assert.Nil(t, store.Put("client", session))
+
+	// using the session does not extend its lifetime
+	*now = now.Add(50 * time.Second)
+	assert.Nil(t, store.Touch("client"))
+	_, err := store.Get("client")
+	assert.Nil(t, err)
+
+	*now = now.Add(20 * time.Second)
+	_, err = store.Get("client")
+	assert.Equal(t, ErrSessionExpired, err)
+
+	// expired sessions are removed
+	_, err = store.Get("client")
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestInMemSessionStoreTTLPrune(t *testing.T) {
+	store, now := newTestStore(SessionOptions{TTL: time.Minute})
+
+	for _, id := range []string{"a", "b"} {
+		session := newTestSession(t, id)
+		session.Created = *now
+		assert.Nil(t, store.Put(id, session))
+		*now = now.Add(30 * time.Second)
+	}
+
+	// the sessions past their TTL are dropped by the next handshake, even
+	// when their clients never come back
+	*now = now.Add(time.Second)
+	session := newTestSession(t, "c")
+	session.Created = *now
+	assert.Nil(t, store.Put("c", session))
+
+	assert.Equal(t, 2, store.lru.Len())
+	assert.NotContains(t, store.index, "a")
+	assert.Equal(t, 2, store.ttl.Len())
+
+	// a new handshake restarts the TTL of the client
+	session = newTestSession(t, "b")
+	session.Created = *now
+	assert.Nil(t, store.Put("b", session))
+	*now = now.Add(45 * time.Second)
+	session = newTestSession(t, "d")
+	session.Created = *now
+	assert.Nil(t, store.Put("d", session))
+
+	_, err := store.Get("b")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, store.lru.Len())
+	assert.Equal(t, 3, store.ttl.Len())
+
+	assert.Nil(t, store.Delete("c"))
+	assert.Equal(t, 2, store.ttl.Len())
+}
+
+func TestInMemSessionStoreIdleTimeout(t *testing.T) {
+	store, now := newTestStore(SessionOptions{IdleTimeout: time.Minute})
+
+	assert.Nil(t, store.Put("client", newTestSession(t, "jwt")))
+
+	// using the session keeps it alive
+	*now = now.Add(50 * time.Second)
+	assert.Nil(t, store.Touch("client"))
+	*now = now.Add(50 * time.Second)
+	_, err := store.Get("client")
+	assert.Nil(t, err)
+
+	*now = now.Add(2 * time.Minute)
+	_, err = store.Get("client")
+	assert.Equal(t, ErrSessionExpired, err)
+}
+
+func TestInMemSessionStoreMaxSessions(t *testing.T) {
+	store, now := newTestStore(SessionOptions{MaxSessions: 2})
+
+	assert.Nil(t, store.Put("a", newTestSession(t, "a")))
+	*now = now.Add(time.Second)
+	assert.Nil(t, store.Put("b", newTestSession(t, "b")))
+	*now = now.Add(time.Second)
+	assert.Nil(t, store.Touch("a"))
+	*now = now.Add(time.Second)
+
+	// "b" is the least recently used session
+	assert.Nil(t, store.Put("c", newTestSession(t, "c")))
+
+	_, err := store.Get("b")
+	assert.Equal(t, ErrSessionNotFound, err)
+	_, err = store.Get("a")
+	assert.Nil(t, err)
+	_, err = store.Get("c")
+	assert.Nil(t, err)
+}
+
+func TestSetSessionStore(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+
+	InitInMemStorage(pri, pub)
+	store := NewInMemSessionStore(SessionOptions{})
+	SetSessionStore(store)
+
+	assert.Equal(t, store, GetInMemStorage().Sessions)
+}
+
+func TestGetSessionTTL(t *testing.T) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+	assert.Nil(t, InitInMemStorage(pri, pub, WithSessionOptions(SessionOptions{TTL: time.Minute})))
+
+	// a store without limits of its own, as a custom store
+	SetSessionStore(NewInMemSessionStore(SessionOptions{}))
+	db := GetInMemStorage()
+
+	fresh := newTestSession(t, "fresh")
+	old := newTestSession(t, "old")
+	old.Created = time.Now().Add(-2 * time.Minute)
+	assert.Nil(t, db.Sessions.Put("fresh", fresh))
+	assert.Nil(t, db.Sessions.Put("old", old))
+
+	session, err := db.GetSession("fresh")
+	assert.Nil(t, err)
+	assert.Equal(t, fresh, session)
+
+	_, err = db.GetSession("old")
+	assert.Equal(t, ErrSessionExpired, err)
+	_, err = db.Sessions.Get("old")
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestInMemSessionStoreConcurrentAccess(t *testing.T) {
+	store := NewInMemSessionStore(SessionOptions{MaxSessions: 50})
+	session := newTestSession(t, "jwt")
+
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < 1000; j++ {
+				id := fmt.Sprintf("client-%d-%d", i, j%100)
+				store.Put(id, session)
+				store.Touch(id)
+				store.Get(id)
+				if j%10 == 0 {
+					store.Delete(id)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+
+	assert.LessOrEqual(t, len(store.(*inMemSessionStore).index), 50)
+	assert.Equal(t, len(store.(*inMemSessionStore).index), store.(*inMemSessionStore).lru.Len())
+}
+
+// fillStore returns a store holding n sessions along with their client UUIDs
+func fillStore(b *testing.B, n int) (SessionStore, []string) {
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	if err != nil {
+		b.Fatal(err)
+	}
+	key, err := pri.GetECDHSharedSecret(pub)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	store := NewInMemSessionStore(SessionOptions{})
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("client-%d", i)
+		store.Put(ids[i], &Session{Key: key, JWT: "jwt", Created: time.Now()})
+	}
+	return store, ids
+}
+
+func BenchmarkInMemSessionStoreGet(b *testing.B) {
+	for _, n := range []int{100, 10_000, 100_000} {
+		b.Run(fmt.Sprintf("sessions=%d", n), func(b *testing.B) {
+			store, ids := fillStore(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := store.Get(ids[i%n]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInMemSessionStorePut(b *testing.B) {
+	for _, n := range []int{100, 10_000, 100_000} {
+		b.Run(fmt.Sprintf("sessions=%d", n), func(b *testing.B) {
+			store, ids := fillStore(b, n)
+			session, _ := store.Get(ids[0])
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Put(ids[i%n], session)
+			}
+		})
+	}
+}
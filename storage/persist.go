@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SaveDelay is how long changes are batched before the storage is saved
+var SaveDelay = time.Second
+
+// Persister reads and writes the serialized storage, e.g. from a file
+type Persister interface {
+	// Load returns the saved data, or nil when nothing was saved yet
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// persistMagic starts the persisted data, followed by the scrypt salt of the
+// key, the nonce and the ciphertext
+const persistMagic = "L8P1"
+
+const (
+	persistSaltSize = 16
+	// the scrypt cost parameters of the key derivation
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Persistence saves the storage through Persister, encrypted with a key
+// derived from Secret with scrypt over a random salt stored with the data
+type Persistence struct {
+	Persister Persister
+	Secret    []byte
+
+	// the salt and the key derived from it, derived once per process as
+	// scrypt is slow on purpose
+	mu   sync.Mutex
+	salt []byte
+	key  []byte
+}
+
+// snapshot is the persisted state of the storage
+type snapshot struct {
+	PrivateKey   *utils.JWK                   `json:"private_key"`
+	PublicKey    *utils.JWK                   `json:"public_key"`
+	PreviousKeys []previousKey                `json:"previous_keys,omitempty"`
+	Sessions     map[string]*persistedSession `json:"sessions"`
+}
+
+// persistedSession is a session along with the time it was last used, so
+// that idle timeouts survive a restart
+type persistedSession struct {
+	*Session
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// previousKey is a rotated server key pair still within its grace period
+type previousKey struct {
+	PrivateKey *utils.JWK `json:"private_key"`
+	PublicKey  *utils.JWK `json:"public_key"`
+	RetiresAt  time.Time  `json:"retires_at"`
+}
+
+// aead returns the cipher keyed with the key derived from the secret and salt
+func (p *Persistence) aead(salt []byte) (cipher.AEAD, error) {
+	if len(p.Secret) == 0 {
+		return nil, errors.New("persistence secret must not be empty")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.key == nil || !bytes.Equal(p.salt, salt) {
+		key, err := scrypt.Key(p.Secret, salt, scryptN, scryptR, scryptP, 32)
+		if err != nil {
+			return nil, err
+		}
+		p.salt, p.key = salt, key
+	}
+
+	block, err := aes.NewCipher(p.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// currentSalt returns the salt of the loaded data, or a new random salt
+func (p *Persistence) currentSalt() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.salt == nil {
+		salt := make([]byte, persistSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+		p.salt = salt
+	}
+	return p.salt, nil
+}
+
+func (p *Persistence) encrypt(plaintext []byte) ([]byte, error) {
+	salt, err := p.currentSalt()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := p.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(persistMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+func (p *Persistence) decrypt(ciphertext []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, []byte(persistMagic)) {
+		return nil, errors.New("persisted data is not a layer8 snapshot")
+	}
+	ciphertext = ciphertext[len(persistMagic):]
+	if len(ciphertext) < persistSaltSize {
+		return nil, errors.New("persisted data is truncated")
+	}
+	salt, ciphertext := ciphertext[:persistSaltSize], ciphertext[persistSaltSize:]
+
+	aead, err := p.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("persisted data is truncated")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// load restores the key pair and the sessions from the persisted snapshot
+func (s *inMemStorage) load() error {
+	b, err := s.persistence.Persister.Load()
+	if err != nil {
+		return fmt.Errorf("could not load storage: %s", err.Error())
+	}
+	if len(b) == 0 {
+		return nil
+	}
+
+	b, err = s.persistence.decrypt(b)
+	if err != nil {
+		return fmt.Errorf("could not decrypt storage: %s", err.Error())
+	}
+
+	snap := new(snapshot)
+	if err := json.Unmarshal(b, snap); err != nil {
+		return fmt.Errorf("could not decode storage: %s", err.Error())
+	}
+
+	if snap.PrivateKey != nil && snap.PublicKey != nil {
+		s.ECDH.set(snap.PrivateKey, snap.PublicKey)
+
+		now := s.ECDH.now()
+		for _, k := range snap.PreviousKeys {
+			if now.Before(k.RetiresAt) {
+				s.ECDH.previous = append(s.ECDH.previous, serverKey{pri: k.PrivateKey, pub: k.PublicKey, retiresAt: k.RetiresAt})
+			}
+		}
+	}
+	if store, ok := s.Sessions.(*inMemSessionStore); ok {
+		store.restore(snap.Sessions)
+	}
+	return nil
+}
+
+// Save writes the key pair and the sessions through the persistence
+func (s *inMemStorage) Save() error {
+	if s.persistence == nil {
+		return nil
+	}
+
+	current, previous := s.ECDH.keys()
+	snap := &snapshot{
+		PrivateKey: current.pri,
+		PublicKey:  current.pub,
+	}
+	for _, k := range previous {
+		snap.PreviousKeys = append(snap.PreviousKeys, previousKey{PrivateKey: k.pri, PublicKey: k.pub, RetiresAt: k.retiresAt})
+	}
+	if store, ok := s.Sessions.(*inMemSessionStore); ok {
+		snap.Sessions = store.sessions()
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("could not encode storage: %s", err.Error())
+	}
+	b, err = s.persistence.encrypt(b)
+	if err != nil {
+		return fmt.Errorf("could not encrypt storage: %s", err.Error())
+	}
+	return s.persistence.Persister.Save(b)
+}
+
+// scheduleSave saves the storage once SaveDelay has elapsed, batching the
+// changes made in the meantime
+func (s *inMemStorage) scheduleSave() {
+	save := func() {
+		s.saveMu.Lock()
+		s.saveTimer = nil
+		s.saveMu.Unlock()
+
+		if err := s.Save(); err != nil {
+			println("error saving storage:", err.Error())
+		}
+	}
+
+	if SaveDelay <= 0 {
+		save()
+		return
+	}
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(SaveDelay, save)
+	}
+}
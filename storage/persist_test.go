@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type memPersister struct {
+	data []byte
+}
+
+func (p *memPersister) Load() ([]byte, error) {
+	return p.data, nil
+}
+
+func (p *memPersister) Save(data []byte) error {
+	p.data = data
+	return nil
+}
+
+func TestPersistence(t *testing.T) {
+	SaveDelay = 0
+
+	persister := new(memPersister)
+	persistence := &Persistence{Persister: persister, Secret: []byte("secret")}
+
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+
+	// nothing is persisted yet, the given key pair is used
+	err = InitInMemStorage(pri, pub, WithPersistence(persistence))
+	assert.Nil(t, err)
+	assert.Equal(t, pri, GetInMemStorage().ECDH.GetPrivateKey())
+
+	session := newTestSession(t, "jwt")
+	assert.Nil(t, GetInMemStorage().Sessions.Put("client", session))
+	assert.NotEmpty(t, persister.data)
+	assert.NotContains(t, string(persister.data), "jwt")
+
+	// a restart reloads the key pair and the sessions
+	pri2, pub2, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+
+	err = InitInMemStorage(pri2, pub2, WithPersistence(persistence))
+	assert.Nil(t, err)
+	assert.Equal(t, pri, GetInMemStorage().ECDH.GetPrivateKey())
+	assert.Equal(t, pub, GetInMemStorage().ECDH.GetPublicKey())
+
+	restored, err := GetInMemStorage().Sessions.Get("client")
+	assert.Nil(t, err)
+	assert.Equal(t, session.JWT, restored.JWT)
+	assert.Equal(t, session.Key, restored.Key)
+	assert.True(t, session.Created.Equal(restored.Created))
+
+	// deletions are persisted too
+	assert.Nil(t, GetInMemStorage().Sessions.Delete("client"))
+	err = InitInMemStorage(pri2, pub2, WithPersistence(persistence))
+	assert.Nil(t, err)
+	_, err = GetInMemStorage().Sessions.Get("client")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// the snapshot cannot be read with another secret
+	err = InitInMemStorage(pri2, pub2, WithPersistence(&Persistence{Persister: persister, Secret: []byte("other")}))
+	assert.NotNil(t, err)
+}
+
+func TestPersistenceKeyDerivation(t *testing.T) {
+	persistence := &Persistence{Persister: new(memPersister), Secret: []byte("secret")}
+
+	first, err := persistence.encrypt([]byte("snapshot"))
+	assert.Nil(t, err)
+	assert.Equal(t, persistMagic, string(first[:len(persistMagic)]))
+
+	// the salt is stored with the data, another process derives the same key
+	restarted := &Persistence{Persister: new(memPersister), Secret: []byte("secret")}
+	b, err := restarted.decrypt(first)
+	assert.Nil(t, err)
+	assert.Equal(t, "snapshot", string(b))
+
+	// two deployments with the same secret derive different keys
+	other := &Persistence{Persister: new(memPersister), Secret: []byte("secret")}
+	second, err := other.encrypt([]byte("snapshot"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, first[len(persistMagic):len(persistMagic)+persistSaltSize], second[len(persistMagic):len(persistMagic)+persistSaltSize])
+
+	_, err = restarted.decrypt([]byte(persistMagic + "short"))
+	assert.NotNil(t, err)
+}
+
+func TestPersistenceIdleTimeout(t *testing.T) {
+	SaveDelay = 0
+
+	persister := new(memPersister)
+	persistence := &Persistence{Persister: persister, Secret: []byte("secret")}
+	options := WithSessionOptions(SessionOptions{IdleTimeout: time.Minute})
+
+	pri, pub, err := utils.GenerateKeyPair(utils.ECDH)
+	assert.Nil(t, err)
+
+	err = InitInMemStorage(pri, pub, options, WithPersistence(persistence))
+	assert.Nil(t, err)
+	store := GetInMemStorage().Sessions.(*inMemSessionStore)
+	now := time.Now().Add(-2 * time.Minute)
+	store.now = func() time.Time { return now }
+
+	assert.Nil(t, store.Put("idle", newTestSession(t, "idle")))
+	assert.Nil(t, store.Put("active", newTestSession(t, "active")))
+	now = now.Add(90 * time.Second)
+	assert.Nil(t, store.Touch("active"))
+
+	// the time the sessions were last used is saved with the next change,
+	// and restored with them
+	assert.Nil(t, store.Put("new", newTestSession(t, "new")))
+	err = InitInMemStorage(pri, pub, options, WithPersistence(persistence))
+	assert.Nil(t, err)
+	_, err = GetInMemStorage().Sessions.Get("idle")
+	assert.Equal(t, ErrSessionNotFound, err)
+	_, err = GetInMemStorage().Sessions.Get("active")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,51 @@
+package storage
+
+import "sync"
+
+// ReplayWindowSize is the number of sequence numbers below the highest one
+// that can still arrive out of order
+const ReplayWindowSize = 64
+
+// ReplayWindow is the sliding window of the sequence numbers accepted for a
+// session. It keeps the highest sequence number seen and a bitmap of the
+// ReplayWindowSize numbers below it.
+type ReplayWindow struct {
+	mu sync.Mutex
+
+	Highest uint64 `json:"highest"`
+	// Bitmap has bit i set when sequence number Highest-i was accepted
+	Bitmap uint64 `json:"bitmap"`
+}
+
+// Accept records the sequence number and reports whether it is new. Sequence
+// numbers start at 1; zero, replayed and too old numbers are rejected.
+func (w *ReplayWindow) Accept(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq == 0 {
+		return false
+	}
+
+	if seq > w.Highest {
+		shift := seq - w.Highest
+		if shift >= ReplayWindowSize {
+			w.Bitmap = 0
+		} else {
+			w.Bitmap <<= shift
+		}
+		w.Bitmap |= 1
+		w.Highest = seq
+		return true
+	}
+
+	offset := w.Highest - seq
+	if offset >= ReplayWindowSize {
+		return false
+	}
+	if w.Bitmap&(1<<offset) != 0 {
+		return false
+	}
+	w.Bitmap |= 1 << offset
+	return true
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := new(ReplayWindow)
+
+	assert.False(t, w.Accept(0))
+
+	assert.True(t, w.Accept(1))
+	assert.False(t, w.Accept(1))
+
+	// out of order numbers within the window are accepted once
+	assert.True(t, w.Accept(5))
+	assert.True(t, w.Accept(3))
+	assert.False(t, w.Accept(3))
+	assert.True(t, w.Accept(2))
+	assert.True(t, w.Accept(4))
+	assert.False(t, w.Accept(5))
+
+	// numbers that fell out of the window are rejected
+	assert.True(t, w.Accept(5+ReplayWindowSize))
+	assert.False(t, w.Accept(5))
+	assert.False(t, w.Accept(5+ReplayWindowSize))
+	assert.True(t, w.Accept(6))
+
+	// a large jump clears the window
+	assert.True(t, w.Accept(1000))
+	assert.False(t, w.Accept(1000))
+	assert.True(t, w.Accept(999))
+	assert.False(t, w.Accept(1000-ReplayWindowSize))
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	utils "github.com/globe-and-citizen/layer8-utils"
+)
+
+var (
+	// ErrSessionNotFound is returned by a SessionStore when no session exists for a client
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionExpired is returned by a SessionStore when the session of a client has expired
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// Session is the state kept for a client once the ECDH handshake has completed
+type Session struct {
+	// Key is the symmetric key derived from the ECDH shared secret
+	Key *utils.JWK `json:"key"`
+	// JWT is the mp-JWT presented by the client during the handshake
+	JWT string `json:"jwt"`
+	// Created is the time of the handshake
+	Created time.Time `json:"created"`
+	// KeyID is the id of the server key pair the session was derived from
+	KeyID string `json:"key_id,omitempty"`
+	// Replay holds the sequence numbers accepted so far when replay
+	// protection is enabled
+	Replay *ReplayWindow `json:"replay,omitempty"`
+}
+
+// SessionStore persists client sessions keyed by the client UUID.
+//
+// The in-memory implementation is used by default; a custom implementation
+// can be installed with SetSessionStore to share sessions between processes.
+type SessionStore interface {
+	// Get returns the session of the client, ErrSessionNotFound or ErrSessionExpired
+	Get(clientUUID string) (*Session, error)
+	// Put creates or replaces the session of the client
+	Put(clientUUID string, session *Session) error
+	// Delete removes the session of the client, if any
+	Delete(clientUUID string) error
+	// Touch marks the session of the client as recently used
+	Touch(clientUUID string) error
+}
+
+// ReplayStore is implemented by the session stores that record the accepted
+// sequence numbers themselves, atomically across the processes sharing the
+// store. Other stores get the replay window of the session and put it back
+// synchronously, which is atomic within one process only.
+type ReplayStore interface {
+	// AcceptSeq records the sequence number for the session of the client and
+	// reports whether it is new, see ReplayWindow.Accept
+	AcceptSeq(clientUUID string, seq uint64) (bool, error)
+}